@@ -0,0 +1,405 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Partial mirroring of Debian-style APT repositories.  Packages go in
+// first, and the indices and Release files that refer to them only once
+// all of the packages are in place, so that the mirror is consistent
+// whenever a client looks at it.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const aptMaxIndex = 256 << 20
+
+type aptFile struct {
+	path   string
+	size   int64
+	sha256 string
+}
+
+// parseDeb822 splits control-file text into stanzas of fields.  Values
+// spanning several lines are kept with their newlines.
+func parseDeb822(text string) []map[string]string {
+	var stanzas []map[string]string
+	var cur map[string]string
+	var last string
+	for _, line := range strings.Split(text, "\n") {
+		switch {
+		case strings.TrimSpace(line) == "":
+			if cur != nil {
+				stanzas = append(stanzas, cur)
+				cur = nil
+			}
+		case line[0] == ' ' || line[0] == '\t':
+			if cur != nil && last != "" {
+				cur[last] += "\n" + strings.TrimSpace(line)
+			}
+		default:
+			k, v, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			if cur == nil {
+				cur = make(map[string]string)
+			}
+			last = k
+			cur[k] = strings.TrimSpace(v)
+		}
+	}
+	if cur != nil {
+		stanzas = append(stanzas, cur)
+	}
+	return stanzas
+}
+
+// releaseFiles reads the SHA256 field of a Release file.
+func releaseFiles(rel map[string]string) map[string]aptFile {
+	files := make(map[string]aptFile)
+	for _, line := range strings.Split(rel["SHA256"], "\n") {
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		files[f[2]] = aptFile{f[2], size, f[0]}
+	}
+	return files
+}
+
+// safePath checks that a repository-relative path stays inside the mirror.
+func safePath(p string) error {
+	if p == "" || path.IsAbs(p) {
+		return fmt.Errorf("%q: bad path", p)
+	}
+	for _, e := range strings.Split(p, "/") {
+		if e == "" || e == "." || e == ".." {
+			return fmt.Errorf("%q: bad path", p)
+		}
+	}
+	return nil
+}
+
+type aptMirror struct {
+	url   string
+	out   string
+	keys  []pgpKey
+	dists map[string][]byte // files under dists/, written last
+	rels  []string          // the Release files among them, written very last
+}
+
+func (m *aptMirror) get(p string, max int64) ([]byte, error) {
+	u := m.url + "/" + p
+	if !*qflag {
+		fmt.Println("GET", u)
+	}
+	return fetchBytes(u, max)
+}
+
+// release fetches and verifies InRelease, or Release and Release.gpg.
+func (m *aptMirror) release(suite string) (map[string]string, error) {
+	dir := "dists/" + suite
+	var text []byte
+	b, err := m.get(dir+"/InRelease", aptMaxIndex)
+	var serr *statusError
+	switch {
+	case err == nil:
+		if text, err = pgpVerifyClearsigned(m.keys, b); err != nil {
+			return nil, fmt.Errorf("InRelease: %w", err)
+		}
+		m.dists[dir+"/InRelease"] = b
+		m.rels = append(m.rels, dir+"/InRelease")
+	case errors.As(err, &serr) && serr.code == 404:
+		if text, err = m.get(dir+"/Release", aptMaxIndex); err != nil {
+			return nil, err
+		}
+		sig, err := m.get(dir+"/Release.gpg", 1<<20)
+		if err != nil {
+			return nil, err
+		}
+		if err = pgpVerifyDetached(m.keys, text, sig); err != nil {
+			return nil, fmt.Errorf("Release: %w", err)
+		}
+		m.dists[dir+"/Release"] = text
+		m.dists[dir+"/Release.gpg"] = sig
+		m.rels = append(m.rels, dir+"/Release", dir+"/Release.gpg")
+	default:
+		return nil, err
+	}
+
+	stanzas := parseDeb822(string(text))
+	if len(stanzas) == 0 {
+		return nil, errors.New("Release: empty")
+	}
+	rel := stanzas[0]
+	if vu := rel["Valid-Until"]; vu != "" {
+		t, err := time.Parse(time.RFC1123, vu)
+		if err != nil {
+			t, err = time.Parse(time.RFC1123Z, vu)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Release: bad Valid-Until %q", vu)
+		}
+		if time.Now().After(t) {
+			return nil, fmt.Errorf("Release: expired at %s", vu)
+		}
+	}
+	return rel, nil
+}
+
+// packages fetches the Packages index of a component and architecture,
+// checked against the Release file, and returns the packages it lists.
+func (m *aptMirror) packages(suite, comp, arch string, files map[string]aptFile) ([]aptFile, error) {
+	base := comp + "/binary-" + arch + "/Packages"
+	var text []byte
+	found := false
+	for _, ext := range []string{".gz", ""} {
+		f, ok := files[base+ext]
+		if !ok {
+			continue
+		}
+		p := "dists/" + suite + "/" + f.path
+		b, err := m.get(p, f.size)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkSHA256(b, f); err != nil {
+			return nil, err
+		}
+		m.dists[p] = b
+
+		text = b
+		if ext == ".gz" {
+			zr, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+			text, err = io.ReadAll(io.LimitReader(zr, aptMaxIndex+1))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+			if len(text) > aptMaxIndex {
+				return nil, fmt.Errorf("%s: longer than %d bytes uncompressed",
+					p, aptMaxIndex)
+			}
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: not in Release, or only xz-compressed",
+			base)
+	}
+
+	var debs []aptFile
+	for _, st := range parseDeb822(string(text)) {
+		size, err := strconv.ParseInt(st["Size"], 10, 64)
+		if err != nil || st["Filename"] == "" || st["SHA256"] == "" {
+			return nil, fmt.Errorf("%s: incomplete entry for %q",
+				base, st["Package"])
+		}
+		if err = safePath(st["Filename"]); err != nil {
+			return nil, err
+		}
+		debs = append(debs, aptFile{st["Filename"], size, st["SHA256"]})
+	}
+	return debs, nil
+}
+
+func checkSHA256(b []byte, f aptFile) error {
+	h := sha256.Sum256(b)
+	if int64(len(b)) != f.size || hex.EncodeToString(h[:]) != f.sha256 {
+		return fmt.Errorf("%s: size or SHA256 mismatch", f.path)
+	}
+	return nil
+}
+
+// fetchDeb downloads a package into the mirror, unless a good copy is
+// already there.
+func (m *aptMirror) fetchDeb(f aptFile) error {
+	name := filepath.Join(m.out, filepath.FromSlash(f.path))
+	if fi, err := os.Stat(name); err == nil && fi.Size() == f.size {
+		if h, err := fileSHA256(name); err == nil &&
+			hex.EncodeToString(h) == f.sha256 {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	fp, err := os.CreateTemp(filepath.Dir(name), ".goget*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+
+	u := m.url + "/" + f.path
+	if !*qflag {
+		fmt.Println("GET", u)
+	}
+	h := sha256.New()
+	err = fetchTo(io.MultiWriter(fp, h), u, f.size)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != f.sha256 {
+		return fmt.Errorf("%s: SHA256 mismatch", u)
+	}
+	if err = os.Chmod(fp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), name)
+}
+
+func aptMain(args []string) error {
+	fs := flag.NewFlagSet("apt", flag.ExitOnError)
+	kflag := fs.String("keyring", "", "OpenPGP keyring to verify Release with")
+	aflag := fs.String("arch", "amd64", "comma-separated architectures")
+	oflag := fs.String("o", ".", "mirror directory")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),
+			"usage: goget apt -keyring file [options] url suite component ...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *kflag == "" || fs.NArg() < 3 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	kb, err := os.ReadFile(*kflag)
+	if err != nil {
+		return err
+	}
+	keys, err := readKeyring(kb)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *kflag, err)
+	}
+	m := &aptMirror{
+		url:   strings.TrimSuffix(fs.Arg(0), "/"),
+		out:   *oflag,
+		keys:  keys,
+		dists: make(map[string][]byte),
+	}
+	suite := fs.Arg(1)
+	if err = safePath(suite); err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(m.out, 0755); err != nil {
+		return err
+	}
+	lk, err := lockFile(filepath.Join(m.out, ".goget-apt.lock"), 0644, false)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.out, err)
+	}
+	defer unlockFile(lk, true)
+
+	rel, err := m.release(suite)
+	if err != nil {
+		return err
+	}
+	files := releaseFiles(rel)
+	seen := make(map[string]bool)
+	var debs []aptFile
+	for _, comp := range fs.Args()[2:] {
+		for _, arch := range strings.Split(*aflag, ",") {
+			l, err := m.packages(suite, comp, arch, files)
+			if err != nil {
+				return err
+			}
+			for _, f := range l {
+				if !seen[f.path] {
+					seen[f.path] = true
+					debs = append(debs, f)
+				}
+			}
+		}
+	}
+
+	failed := 0
+	ch := make(chan error, *pflag)
+	routines := 0
+	wait := func() {
+		if err := <-ch; err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed++
+		}
+		routines--
+	}
+	for _, f := range debs {
+		if routines >= *pflag {
+			wait()
+		}
+		go func(f aptFile) { ch <- m.fetchDeb(f) }(f)
+		routines++
+	}
+	for routines > 0 {
+		wait()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d packages failed; indices left as they were",
+			failed, len(debs))
+	}
+
+	// Release files go last, so that they never describe indices that
+	// aren't there yet.
+	for p, b := range m.dists {
+		if contains(m.rels, p) {
+			continue
+		}
+		if err = m.writeDist(p, b); err != nil {
+			return err
+		}
+	}
+	for _, p := range m.rels {
+		if err = m.writeDist(p, m.dists[p]); err != nil {
+			return err
+		}
+	}
+	if !*qflag {
+		fmt.Println("mirrored", len(debs), "packages")
+	}
+	return nil
+}
+
+func (m *aptMirror) writeDist(p string, b []byte) error {
+	name := filepath.Join(m.out, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(name, b, 0644)
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// An audit log of downloads, one JSON object per line.  Each entry has
+// the SHA-256 of the line before it, so that changing or removing an
+// entry breaks the chain for every one after it.  Entries can still be
+// cut off the end unnoticed, so "goget audit verify" gives the hash of the
+// last entry, for keeping somewhere else.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+var auditFlag = flag.String("audit-log", "",
+	"append an entry for each download to this tamper-evident log")
+
+// audit is the audit log, if there is one.
+var audit *auditLog
+
+type auditLog struct {
+	path string
+	user string
+	mu   sync.Mutex
+}
+
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	URL      string    `json:"url"`
+	FinalURL string    `json:"final_url,omitempty"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Verified []string  `json:"verified,omitempty"`
+	Shared   bool      `json:"shared,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Prev     string    `json:"prev"`
+}
+
+func newAuditLog(path string) *auditLog {
+	a := &auditLog{path: path, user: os.Getenv("USER")}
+	if u, err := user.Current(); err == nil {
+		a.user = u.Username
+	}
+	return a
+}
+
+func lineHash(line []byte) string {
+	h := sha256.Sum256(line)
+	return hex.EncodeToString(h[:])
+}
+
+// errAuditIncomplete is returned for logs ending in a partial line, such
+// as one left by a crash mid-write.  Another entry appended to it would be
+// chained to the fragment and end up on the same line.
+var errAuditIncomplete = errors.New("ends in an incomplete entry")
+
+// lastLine finds the last line of fp, reading no more of it than needed.
+func lastLine(fp *os.File) ([]byte, error) {
+	size, err := fp.Seek(0, io.SeekEnd)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	for n := int64(4096); ; n *= 2 {
+		off := max(size-n, 0)
+		buf := make([]byte, size-off)
+		if _, err = fp.ReadAt(buf, off); err != nil {
+			return nil, err
+		}
+		if buf[len(buf)-1] != '\n' {
+			return nil, errAuditIncomplete
+		}
+		buf = buf[:len(buf)-1]
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			return buf[i+1:], nil
+		}
+		if off == 0 {
+			return buf, nil
+		}
+	}
+}
+
+// add logs the download of url into path, of size bytes with SHA-256
+// sum, which ended with err.  If shared, another goget did the download
+// while this one waited.  Other gogets may be appending to the log as
+// well, so it is locked while the last entry is read and the new one
+// written.
+func (a *auditLog) add(url, final, path string, size int64, sum []byte, verified []string, shared bool, err error) {
+	if a == nil {
+		return
+	}
+	e := auditEntry{
+		Time:     time.Now().UTC(),
+		User:     a.user,
+		URL:      url,
+		FinalURL: final,
+		Path:     path,
+		Verified: verified,
+		Shared:   shared,
+	}
+	switch {
+	case err != nil:
+		e.Error = err.Error()
+	case sum != nil:
+		e.Size = size
+		e.SHA256 = hex.EncodeToString(sum)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.append(&e); err != nil {
+		fmt.Fprintln(os.Stderr, "audit log:", err)
+	}
+}
+
+func (a *auditLog) append(e *auditEntry) error {
+	fp, err := lockFile(a.path, 0600, true)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	last, err := lastLine(fp)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	if last != nil {
+		e.Prev = lineHash(last)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// The lock keeps others from writing, and we're at the end.
+	_, err = fp.Write(append(b, '\n'))
+	return err
+}
+
+// verifyAudit checks the chain of the log at path, and returns the number
+// of entries and the hash of the last one.
+func verifyAudit(path string) (int, string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer fp.Close()
+
+	n, prev := 0, ""
+	r := bufio.NewReader(fp)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return n, prev, err
+		}
+		n++
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			return n, prev, fmt.Errorf("%s:%d: incomplete entry", path, n)
+		}
+		line = line[:len(line)-1]
+		var e auditEntry
+		if err = json.Unmarshal(line, &e); err != nil {
+			return n, prev, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if e.Prev != prev {
+			return n, prev, fmt.Errorf("%s:%d: chain broken: entry before it has hash %s, but this one says %s",
+				path, n, prev, e.Prev)
+		}
+		prev = lineHash(line)
+	}
+	return n, prev, nil
+}
+
+func auditMain(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goget audit verify [log]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 || fs.Arg(0) != "verify" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := *auditFlag
+	if fs.NArg() == 2 {
+		path = fs.Arg(1)
+	}
+	if path == "" {
+		return errors.New("no audit log given, as an argument or with -audit-log")
+	}
+
+	n, last, err := verifyAudit(path)
+	if err != nil {
+		return err
+	}
+	if !*qflag {
+		fmt.Printf("%s: %d entries OK, last %s\n", path, n, last)
+	}
+	return nil
+}
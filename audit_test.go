@@ -0,0 +1,48 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit")
+	a := newAuditLog(path)
+	a.add("http://example.com/a", "", "a", 0, nil, nil, false, nil)
+	a.add("http://example.com/b", "", "b", 0, nil, nil, false, nil)
+	if n, _, err := verifyAudit(path); err != nil || n != 2 {
+		t.Fatalf("verify: %d entries, %v", n, err)
+	}
+
+	// As if a goget had crashed while writing an entry.
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteString(`{"time":"2024-`)
+	fp.Close()
+	before, _ := os.ReadFile(path)
+
+	if err = a.append(&auditEntry{URL: "http://example.com/c"}); !errors.Is(err, errAuditIncomplete) {
+		t.Errorf("append: got %v, want %v", err, errAuditIncomplete)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Errorf("log changed to %q", after)
+	}
+}
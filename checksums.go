@@ -0,0 +1,169 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Checksums published next to downloads, as file.sha256 and the like, or
+// in a SHA256SUMS-style list for the whole directory.
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+var checksumFlag = flag.Bool("checksums", false,
+	"look for published checksum files next to downloads and verify against them")
+
+type checksumKind struct {
+	name   string
+	size   int // of the sum in bytes
+	new    func() hash.Hash
+	suffix string // of the per-file sibling
+	list   string // directory-wide list
+}
+
+// checksumKinds are tried in this order, strongest first.
+var checksumKinds = []checksumKind{
+	{"SHA512", sha512.Size, sha512.New, ".sha512", "SHA512SUMS"},
+	{"SHA256", sha256.Size, sha256.New, ".sha256", "SHA256SUMS"},
+	{"MD5", md5.Size, md5.New, ".md5", "MD5SUMS"},
+}
+
+// findSum looks for the sum of file name in text, which is either a list
+// of sums in the coreutils or BSD format, or with single, just a sum.
+func findSum(text, name string, k checksumKind, single bool) []byte {
+	for _, line := range strings.Split(text, "\n") {
+		// File names may have spaces, so only the sum is a field.
+		line = strings.TrimSpace(line)
+		var sum, file string
+		if alg, rest, ok := strings.Cut(line, " ("); ok &&
+			strings.EqualFold(alg, k.name) {
+			// "SHA256 (file) = sum"
+			i := strings.LastIndex(rest, ") = ")
+			if i < 0 {
+				continue
+			}
+			file, sum = rest[:i], rest[i+len(") = "):]
+		} else if sum, file, ok = strings.Cut(line, " "); ok {
+			// "sum  file", or "sum *file" for binary mode
+			file = strings.TrimPrefix(file, " ")
+			file = strings.TrimPrefix(file, "*")
+			if file == "" {
+				continue
+			}
+		} else if !single {
+			continue
+		}
+		// Lists are of the files in their directory; a file in a
+		// subdirectory of it is another file.
+		if file != "" && strings.TrimPrefix(file, "./") != name && !single {
+			continue
+		}
+		b, err := hex.DecodeString(sum)
+		if err == nil && len(b) == k.size {
+			return b
+		}
+	}
+	return nil
+}
+
+// checksum is a published checksum of a download, and where it was found.
+type checksum struct {
+	kind *checksumKind
+	sum  []byte
+	src  string
+}
+
+// findChecksum looks for a checksum of u published next to it.  It
+// returns nil if there is none.
+func findChecksum(u string) (*checksum, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(pu.Path)
+	dir := *pu
+	dir.Path = strings.TrimSuffix(path.Dir(pu.Path), "/") + "/"
+	dir.RawPath, dir.RawQuery, dir.Fragment = "", "", ""
+
+	for i := range checksumKinds {
+		k := &checksumKinds[i]
+		srcs := []struct {
+			url    string
+			single bool
+		}{
+			{strings.TrimSuffix(u, "?"+pu.RawQuery) + k.suffix, true},
+			{dir.String() + k.list, false},
+		}
+		for _, src := range srcs {
+			b, err := fetchBytes(src.url, 1<<20)
+			var serr *statusError
+			if errors.As(err, &serr) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if want := findSum(string(b), name, *k, src.single); want != nil {
+				return &checksum{k, want, src.url}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// check checks the file f against c.
+func (c *checksum) check(f string) error {
+	h := c.kind.new()
+	fp, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if _, err = io.Copy(h, fp); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), c.sum) {
+		return fmt.Errorf("%s mismatch with %s", c.kind.name, c.src)
+	}
+	return nil
+}
+
+// verifyChecksum checks f, downloaded from u, against c, the checksum
+// published next to it, if there is one.
+func verifyChecksum(u, f string, c *checksum) error {
+	if c == nil {
+		fmt.Fprintln(os.Stderr, u+": no published checksum found")
+		return nil
+	}
+	if err := c.check(f); err != nil {
+		return fmt.Errorf("%s: %w", u, err)
+	}
+	if !*qflag {
+		fmt.Println(c.kind.name, "OK:", u, "from", c.src)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestFindSum(t *testing.T) {
+	var k checksumKind
+	for _, c := range checksumKinds {
+		if c.name == "SHA256" {
+			k = c
+		}
+	}
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("b", 64)
+	for _, c := range []struct {
+		text, name string
+		single     bool
+		want       string
+	}{
+		{a + "  release.tar.gz\n", "release.tar.gz", false, a},
+		{a + " *release.tar.gz\n", "release.tar.gz", false, a},
+		{a + "  ./release.tar.gz\n", "release.tar.gz", false, a},
+		{"SHA256 (release.tar.gz) = " + a + "\n", "release.tar.gz", false, a},
+		{a + "  my release.tar.gz\r\n", "my release.tar.gz", false, a},
+		{"SHA256 (my release (1).tar.gz) = " + a, "my release (1).tar.gz", false, a},
+		{a + "  other.tar.gz\n", "release.tar.gz", false, ""},
+		// Another file of the same name, further down.
+		{a + "  subdir/release.tar.gz\n" + b + "  release.tar.gz\n", "release.tar.gz", false, b},
+		{a + "  subdir/release.tar.gz\n", "release.tar.gz", false, ""},
+		{a + "\n", "release.tar.gz", true, a},
+		{a + "  release.tar.gz\n", "renamed.tar.gz", true, a},
+		{a[:62] + "  release.tar.gz\n", "release.tar.gz", false, ""},
+	} {
+		got := hex.EncodeToString(findSum(c.text, c.name, k, c.single))
+		if got != c.want {
+			t.Errorf("%q for %q: got %q, expected %q", c.text, c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+)
+
+// client is what every HTTP request goes through.  main replaces it with
+// one set up according to the command line.
+var client = http.DefaultClient
+
+// tlsConfig is what TLS connections start from, for protocols other than
+// HTTP.  newClient sets it up along with client.
+var tlsConfig = &tls.Config{}
+
+// newClient builds the HTTP client from the command line options.
+func newClient() (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// We may dial TLS ourselves, and still want HTTP/2 when we do.
+	t.ForceAttemptHTTP2 = true
+	t.TLSClientConfig = &tls.Config{}
+
+	switch *daneFlag {
+	case "off", "also", "only":
+	default:
+		return nil, fmt.Errorf("%q: -dane must be off, also or only",
+			*daneFlag)
+	}
+
+	d, err := newDial()
+	if err != nil {
+		return nil, err
+	}
+	dial = d
+	t.DialContext = dial
+	if *tlsSessionsFlag != "" {
+		sessions, err = newSessionCache(*tlsSessionsFlag)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.ClientSessionCache = sessions
+	}
+	if *knownHostsFlag != "" {
+		// Checked by the dialers, which know the address dialed.
+		if hostKeys, err = loadKnownHosts(*knownHostsFlag); err != nil {
+			return nil, err
+		}
+	}
+	if *ctLogsFlag != "" {
+		if ctLogs, err = loadCTPolicy(*ctLogsFlag, *ctMinFlag); err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.VerifyConnection = ctLogs.verify
+	}
+	if v := t.TLSClientConfig.VerifyConnection; v != nil {
+		t.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return certError(cs, v(cs))
+		}
+	}
+
+	var rt http.RoundTripper = t
+	td := tlsDialer{tls: t.TLSClientConfig, dial: t.DialContext}
+	switch {
+	case *svcbFlag:
+		d := &svcbDialer{
+			tlsDialer: td,
+			records:   make(map[string]svcbLookup),
+		}
+		t.DialTLSContext = d.dialTLS
+		rt = &svcbUpgrader{d, t}
+	case *daneFlag != "off", hostKeys != nil:
+		t.DialTLSContext = td.dialTLS
+	}
+	if proxy := t.Proxy; proxy != nil && *daneFlag != "off" {
+		// Through a proxy, the transport does the TLS handshake itself
+		// and never calls DialTLSContext, so there would be no DANE.
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			u, err := proxy(req)
+			if u != nil && req.URL.Scheme == "https" {
+				return nil, fmt.Errorf("%s: DANE can't be checked through proxy %s",
+					req.URL.Host, u.Redacted())
+			}
+			return u, err
+		}
+	}
+	if len(credSources) > 0 {
+		rt = &credTransport{rt: rt, cache: make(map[string]*cred)}
+	}
+	if *otlpFlag != "" {
+		rt = &traceTransport{rt}
+	}
+	tlsConfig = t.TLSClientConfig
+	return &http.Client{Transport: rt}, nil
+}
+
+// certError marks err, from checking the certificates in cs, as a
+// certificate verification error, the way crypto/tls marks its own.
+func certError(cs tls.ConnectionState, err error) error {
+	var cerr *tls.CertificateVerificationError
+	if err == nil || errors.As(err, &cerr) {
+		return err
+	}
+	return &tls.CertificateVerificationError{
+		UnverifiedCertificates: cs.PeerCertificates,
+		Err:                    err,
+	}
+}
+
+// tlsDialer makes TLS connections itself, for when they need more than
+// the transport would do.
+type tlsDialer struct {
+	tls  *tls.Config
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (d *tlsDialer) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := d.tls.Clone()
+	cfg.ServerName = host
+	cfg.NextProtos = []string{"h2", "http/1.1"}
+	cfg = hostKeys.config(cfg, addr)
+	if cfg, err = daneConfig(cfg, host, port); err != nil {
+		return nil, err
+	}
+	return d.handshake(ctx, network, addr, cfg)
+}
+
+// handshake dials addr and does a TLS handshake with cfg.  If the server
+// turns down our ECH configuration but offers another one, that is tried
+// once.
+func (d *tlsDialer) handshake(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	cfg = cfg.Clone()
+	for try := 0; ; try++ {
+		raw, err := d.dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// The transport only reports handshakes it does itself.
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		c := tls.Client(raw, cfg)
+		err = c.HandshakeContext(ctx)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(c.ConnectionState(), err)
+		}
+		if err == nil {
+			if c.ConnectionState().ECHAccepted && !*qflag {
+				fmt.Println("connected to", cfg.ServerName, "with ECH")
+			}
+			return c, nil
+		}
+		raw.Close()
+
+		var rej *tls.ECHRejectionError
+		if try == 0 && errors.As(err, &rej) && len(rej.RetryConfigList) > 0 {
+			cfg.EncryptedClientHelloConfigList = rej.RetryConfigList
+			continue
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Credentials from outside goget: git credential helpers, pass(1), or
+// files named in the environment.  They are only asked for when a server
+// wants them, and kept in memory for the rest of the run.
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// credSources are the -credential options, in order.
+var credSources []credSource
+
+func init() {
+	flag.Func("credential",
+		"`[pattern=]source` of credentials for a host or scheme://host: "+
+			"pass:ENTRY, env:VAR naming a file, or a git credential helper command (may be repeated)",
+		func(s string) error {
+			c, err := parseCredSource(s)
+			if err == nil {
+				credSources = append(credSources, c)
+			}
+			return err
+		})
+}
+
+type credSource struct {
+	pattern string // host or scheme://host
+	any     bool   // no pattern was given
+	kind    string // pass, env or helper
+	arg     string
+}
+
+type cred struct {
+	user, pass string
+	src        *credSource
+	approved   sync.Once
+}
+
+// parseCredSource parses [pattern=]source.  An = after the first space
+// belongs to a helper command line, not to a pattern.
+func parseCredSource(s string) (credSource, error) {
+	var c credSource
+	if i := strings.IndexByte(s, '='); i >= 0 &&
+		!strings.ContainsAny(s[:i], " \t") {
+		c.pattern, s = s[:i], s[i+1:]
+	} else {
+		c.any = true
+	}
+	switch {
+	case strings.HasPrefix(s, "pass:"):
+		c.kind, c.arg = "pass", s[len("pass:"):]
+	case strings.HasPrefix(s, "env:"):
+		c.kind, c.arg = "env", s[len("env:"):]
+	default:
+		c.kind, c.arg = "helper", s
+	}
+	if c.arg == "" {
+		return c, fmt.Errorf("%q: empty credential source", s)
+	}
+	return c, nil
+}
+
+// match tells how well c's pattern matches u, with 0 being not at all.
+// Credentials only go out in the clear if the pattern names the scheme.
+func (c *credSource) match(u *url.URL) int {
+	switch {
+	case c.pattern == "" && !c.any:
+		return 0
+	case c.pattern == u.Scheme+"://"+u.Host,
+		c.pattern == u.Scheme+"://"+u.Hostname():
+		return 3
+	case u.Scheme != "https":
+		return 0
+	case c.any:
+		return 1
+	case c.pattern == u.Host, c.pattern == u.Hostname():
+		return 2
+	}
+	return 0
+}
+
+// get asks the source for credentials for u.
+func (c *credSource) get(u *url.URL) (*cred, error) {
+	cr := &cred{user: u.User.Username(), src: c}
+	switch c.kind {
+	case "pass":
+		out, err := exec.Command("pass", "show", c.arg).Output()
+		if err != nil {
+			return nil, fmt.Errorf("pass %s: %w", c.arg, err)
+		}
+		// The password, and then key: value lines.
+		lines := strings.Split(string(out), "\n")
+		cr.pass = lines[0]
+		for _, l := range lines[1:] {
+			k, v, _ := strings.Cut(l, ":")
+			switch strings.ToLower(k) {
+			case "login", "user", "username":
+				cr.user = strings.TrimSpace(v)
+			}
+		}
+	case "env":
+		name := os.Getenv(c.arg)
+		if name == "" {
+			return nil, fmt.Errorf("$%s is not set", c.arg)
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		// user:password, or just the password.
+		line, _, _ := strings.Cut(string(b), "\n")
+		line = strings.TrimSuffix(line, "\r")
+		if user, pass, ok := strings.Cut(line, ":"); ok {
+			cr.user, cr.pass = user, pass
+		} else {
+			cr.pass = line
+		}
+	case "helper":
+		out, err := c.helper("get", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(bytes.NewReader(out))
+		for sc.Scan() {
+			k, v, _ := strings.Cut(sc.Text(), "=")
+			switch k {
+			case "username":
+				cr.user = v
+			case "password":
+				cr.pass = v
+			case "quit":
+				if v == "1" || v == "true" {
+					return nil, nil
+				}
+			}
+		}
+	}
+	if cr.pass == "" {
+		return nil, nil
+	}
+	return cr, nil
+}
+
+// helper runs a git credential helper with action and the description of
+// u, and of cr if there is one.
+func (c *credSource) helper(action string, u *url.URL, cr *cred) ([]byte, error) {
+	kv := []string{"protocol", u.Scheme, "host", u.Host}
+	if cr != nil {
+		kv = append(kv, "username", cr.user, "password", cr.pass)
+	} else if u.User != nil {
+		kv = append(kv, "username", u.User.Username())
+	}
+	var in bytes.Buffer
+	for i := 0; i < len(kv); i += 2 {
+		// A newline would start another attribute; git refuses
+		// them too.
+		if strings.ContainsAny(kv[i+1], "\n\x00") {
+			return nil, fmt.Errorf("credential helper %q: newline or NUL in %s",
+				c.arg, kv[i])
+		}
+		fmt.Fprintf(&in, "%s=%s\n", kv[i], kv[i+1])
+	}
+	in.WriteString("\n")
+
+	cmd := exec.Command("/bin/sh", "-c", c.arg+" "+action)
+	cmd.Stdin = &in
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %q: %w", c.arg, err)
+	}
+	return out, nil
+}
+
+// report tells a helper whether its credentials worked, so that it can
+// store or forget them.
+func (cr *cred) report(u *url.URL, ok bool) {
+	if cr.src.kind != "helper" {
+		return
+	}
+	run := func(action string) {
+		if _, err := cr.src.helper(action, u, cr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if ok {
+		cr.approved.Do(func() { run("approve") })
+	} else {
+		run("reject")
+	}
+}
+
+// credTransport answers a 401 with credentials from the sources that
+// match, trying again once with them.
+type credTransport struct {
+	rt http.RoundTripper
+
+	ask   sync.Mutex // held while a source is asked
+	mu    sync.Mutex
+	cache map[string]*cred // by scheme://host, with nil for none
+}
+
+func (ct *credTransport) cached(key string) (*cred, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	cr, ok := ct.cache[key]
+	return cr, ok
+}
+
+// lookup finds credentials for u in the cache or, failing that, the
+// best matching source.  Sources may ask the user, so they are asked one
+// at a time, and only once.
+func (ct *credTransport) lookup(u *url.URL) (*cred, error) {
+	key := u.Scheme + "://" + u.Host
+	if cr, ok := ct.cached(key); ok {
+		return cr, nil
+	}
+	ct.ask.Lock()
+	defer ct.ask.Unlock()
+	if cr, ok := ct.cached(key); ok {
+		return cr, nil
+	}
+
+	var best *credSource
+	bestScore := 0
+	for i := range credSources {
+		if s := credSources[i].match(u); s > bestScore {
+			best, bestScore = &credSources[i], s
+		}
+	}
+	var cr *cred
+	if best != nil {
+		var err error
+		if cr, err = best.get(u); err != nil {
+			return nil, err
+		}
+	}
+	ct.mu.Lock()
+	ct.cache[key] = cr
+	ct.mu.Unlock()
+	return cr, nil
+}
+
+func (ct *credTransport) forget(u *url.URL) {
+	ct.mu.Lock()
+	delete(ct.cache, u.Scheme+"://"+u.Host)
+	ct.mu.Unlock()
+}
+
+func (ct *credTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := ct.rt.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized ||
+		req.Header.Get("Authorization") != "" ||
+		req.Body != nil && req.GetBody == nil {
+		return resp, err
+	}
+
+	cr, err := ct.lookup(req.URL)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if cr == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if r.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	r.SetBasicAuth(cr.user, cr.pass)
+	resp, err = ct.rt.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	ok := resp.StatusCode != http.StatusUnauthorized
+	cr.report(req.URL, ok)
+	if !ok {
+		ct.forget(req.URL)
+	}
+	return resp, nil
+}
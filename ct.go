@@ -0,0 +1,377 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Certificate Transparency (RFC 6962): servers have to show that their
+// certificate was logged, with Signed Certificate Timestamps from logs we
+// know the keys of.  SCTs may come embedded in the certificate, in the
+// TLS handshake, or in a stapled OCSP response.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+var ctLogsFlag = flag.String("ct-logs", "",
+	"require Signed Certificate Timestamps from the CT logs whose public keys are in this PEM file")
+var ctMinFlag = flag.Int("ct-min", 1,
+	"with -ct-logs, how many different logs must have SCTs for a certificate")
+
+var (
+	oidEmbeddedSCT = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+	oidOCSPSCT     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 5}
+	oidOCSPBasic   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+)
+
+// ctPolicy is the logs we trust, by log ID, and how many of them a
+// certificate has to be in.
+type ctPolicy struct {
+	logs map[[32]byte]crypto.PublicKey
+	min  int
+}
+
+type sct struct {
+	logID     [32]byte
+	timestamp uint64
+	ext       []byte
+	hashAlg   uint8
+	sigAlg    uint8
+	sig       []byte
+}
+
+func loadCTPolicy(path string, min int) (*ctPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &ctPolicy{logs: make(map[[32]byte]crypto.PublicKey), min: min}
+	for {
+		var blk *pem.Block
+		blk, b = pem.Decode(b)
+		if blk == nil {
+			break
+		}
+		if blk.Type != "PUBLIC KEY" {
+			continue
+		}
+		k, err := x509.ParsePKIXPublicKey(blk.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		p.logs[sha256.Sum256(blk.Bytes)] = k
+	}
+	if len(p.logs) == 0 {
+		return nil, fmt.Errorf("%s: no CT log keys", path)
+	}
+	if min < 1 || min > len(p.logs) {
+		return nil, fmt.Errorf("-ct-min %d makes no sense with %d logs",
+			min, len(p.logs))
+	}
+	return p, nil
+}
+
+// parseSCTList parses a SignedCertificateTimestampList.
+func parseSCTList(b []byte) ([]sct, error) {
+	bad := errors.New("bad SCT list")
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return nil, bad
+	}
+	var l []sct
+	for b = b[2:]; len(b) > 0; {
+		if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+			return nil, bad
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		s, err := parseSCT(b[2 : 2+n])
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, s)
+		b = b[2+n:]
+	}
+	return l, nil
+}
+
+func parseSCT(b []byte) (sct, error) {
+	var s sct
+	bad := errors.New("bad SCT")
+	// version, log ID, timestamp, extensions length
+	if len(b) < 1+32+8+2 || b[0] != 0 {
+		return s, bad
+	}
+	copy(s.logID[:], b[1:33])
+	s.timestamp = binary.BigEndian.Uint64(b[33:])
+	n := int(binary.BigEndian.Uint16(b[41:]))
+	b = b[43:]
+	if len(b) < n+4 {
+		return s, bad
+	}
+	s.ext, b = b[:n], b[n:]
+	s.hashAlg, s.sigAlg = b[0], b[1]
+	n = int(binary.BigEndian.Uint16(b[2:]))
+	if len(b) != 4+n {
+		return s, bad
+	}
+	s.sig = b[4:]
+	return s, nil
+}
+
+// verify checks the signature of s over a certificate entry: the
+// certificate itself, or for a precertificate, the issuer's key hash and
+// the TBSCertificate.
+func (s *sct) verify(key crypto.PublicKey, entryType uint16, entry []byte) error {
+	if s.hashAlg != 4 { // SHA-256
+		return errors.New("unsupported SCT hash")
+	}
+	msg := []byte{0, 0} // v1, certificate_timestamp
+	msg = binary.BigEndian.AppendUint64(msg, s.timestamp)
+	msg = binary.BigEndian.AppendUint16(msg, entryType)
+	msg = append(msg, entry...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(s.ext)))
+	msg = append(msg, s.ext...)
+	h := sha256.Sum256(msg)
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if s.sigAlg == 3 && ecdsa.VerifyASN1(k, h[:], s.sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if s.sigAlg == 1 &&
+			rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], s.sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("bad SCT signature")
+}
+
+func appendUint24(b []byte, n int) []byte {
+	return append(b, byte(n>>16), byte(n>>8), byte(n))
+}
+
+// precertTBS takes the SCT extension back out of c's TBSCertificate,
+// leaving what the logs signed.
+func precertTBS(c *x509.Certificate) ([]byte, error) {
+	var tbs asn1.RawValue
+	if _, err := asn1.Unmarshal(c.RawTBSCertificate, &tbs); err != nil {
+		return nil, err
+	}
+	var out []byte
+	for rest := tbs.Bytes; len(rest) > 0; {
+		var v asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &v); err != nil {
+			return nil, err
+		}
+		if v.Class != asn1.ClassContextSpecific || v.Tag != 3 {
+			out = append(out, v.FullBytes...)
+			continue
+		}
+		var exts, keep []pkix.Extension
+		if _, err = asn1.Unmarshal(v.Bytes, &exts); err != nil {
+			return nil, err
+		}
+		for _, e := range exts {
+			if !e.Id.Equal(oidEmbeddedSCT) {
+				keep = append(keep, e)
+			}
+		}
+		b, err := asn1.Marshal(keep)
+		if err != nil {
+			return nil, err
+		}
+		b, err = asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific,
+			Tag: 3, IsCompound: true, Bytes: b})
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal,
+		Tag: asn1.TagSequence, IsCompound: true, Bytes: out})
+}
+
+// ocspSCTs digs the SCT lists out of the single responses of a stapled
+// OCSP response.  The response's own signature doesn't matter, as the
+// SCTs are signed by the logs.
+func ocspSCTs(b []byte) ([][]byte, error) {
+	var resp struct {
+		Status asn1.Enumerated
+		Bytes  struct {
+			Type     asn1.ObjectIdentifier
+			Response []byte
+		} `asn1:"explicit,tag:0,optional"`
+	}
+	if _, err := asn1.Unmarshal(b, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != 0 || !resp.Bytes.Type.Equal(oidOCSPBasic) {
+		return nil, nil
+	}
+	var basic struct {
+		Data struct {
+			Version   int `asn1:"optional,explicit,default:0,tag:0"`
+			Responder asn1.RawValue
+			Produced  time.Time `asn1:"generalized"`
+			Responses []struct {
+				CertID     asn1.RawValue
+				Status     asn1.RawValue
+				ThisUpdate time.Time        `asn1:"generalized"`
+				NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+				Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+			}
+			Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+		}
+		Alg   asn1.RawValue
+		Sig   asn1.BitString
+		Certs asn1.RawValue `asn1:"explicit,tag:0,optional"`
+	}
+	if _, err := asn1.Unmarshal(resp.Bytes.Response, &basic); err != nil {
+		return nil, err
+	}
+	var lists [][]byte
+	for _, r := range basic.Data.Responses {
+		for _, e := range r.Extensions {
+			if e.Id.Equal(oidOCSPSCT) {
+				lists = append(lists, e.Value)
+			}
+		}
+	}
+	return lists, nil
+}
+
+// ctIssuer finds the issuer of the server's certificate in the verified
+// chain.  Without one, as with known hosts, it is whichever of the other
+// certificates the server sent signed it, if any.  The server may send
+// them in any order, or send others.
+func ctIssuer(cs tls.ConnectionState) *x509.Certificate {
+	if len(cs.VerifiedChains) > 0 {
+		if chain := cs.VerifiedChains[0]; len(chain) > 1 {
+			return chain[1]
+		}
+		return nil
+	}
+	leaf := cs.PeerCertificates[0]
+	for _, c := range cs.PeerCertificates[1:] {
+		if leaf.CheckSignatureFrom(c) == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// ctLogs is the -ct-logs policy, if there is one.
+var ctLogs *ctPolicy
+
+// verify is a tls.Config.VerifyConnection that fails unless enough of
+// our logs have SCTs for the server's certificate.  With no policy, it
+// passes everything.
+func (p *ctPolicy) verify(cs tls.ConnectionState) error {
+	if p == nil {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	certEntry := appendUint24(nil, len(leaf.Raw))
+	certEntry = append(certEntry, leaf.Raw...)
+
+	type source struct {
+		list      []byte
+		entryType uint16
+	}
+	var srcs []source
+	for _, l := range cs.SignedCertificateTimestamps {
+		// These come one by one; make each a list of one.
+		b := binary.BigEndian.AppendUint16(nil, uint16(len(l)+2))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(l)))
+		srcs = append(srcs, source{append(b, l...), 0})
+	}
+	if len(cs.OCSPResponse) > 0 {
+		lists, err := ocspSCTs(cs.OCSPResponse)
+		if err != nil {
+			return fmt.Errorf("CT: stapled OCSP response: %w", err)
+		}
+		for _, l := range lists {
+			var b []byte
+			if _, err := asn1.Unmarshal(l, &b); err == nil {
+				srcs = append(srcs, source{b, 0})
+			}
+		}
+	}
+	var precertEntry []byte
+	for _, e := range leaf.Extensions {
+		if !e.Id.Equal(oidEmbeddedSCT) {
+			continue
+		}
+		var b []byte
+		if _, err := asn1.Unmarshal(e.Value, &b); err != nil {
+			return fmt.Errorf("CT: embedded SCTs: %w", err)
+		}
+		issuer := ctIssuer(cs)
+		if issuer == nil {
+			return errors.New("CT: no issuer to check embedded SCTs with")
+		}
+		tbs, err := precertTBS(leaf)
+		if err != nil {
+			return fmt.Errorf("CT: %w", err)
+		}
+		ikh := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+		precertEntry = append(ikh[:], appendUint24(nil, len(tbs))...)
+		precertEntry = append(precertEntry, tbs...)
+		srcs = append(srcs, source{b, 1})
+	}
+
+	now := uint64(time.Now().UnixMilli())
+	good := make(map[[32]byte]bool)
+	for _, src := range srcs {
+		scts, err := parseSCTList(src.list)
+		if err != nil {
+			return fmt.Errorf("CT: %w", err)
+		}
+		for _, s := range scts {
+			key, ok := p.logs[s.logID]
+			if !ok || s.timestamp > now {
+				continue
+			}
+			entry := certEntry
+			if src.entryType == 1 {
+				entry = precertEntry
+			}
+			if s.verify(key, src.entryType, entry) == nil {
+				good[s.logID] = true
+			}
+		}
+	}
+	if len(good) < p.min {
+		return fmt.Errorf("%s: CT: valid SCTs from %d of our logs, want %d",
+			cs.ServerName, len(good), p.min)
+	}
+	return nil
+}
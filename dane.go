@@ -0,0 +1,225 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// DANE (RFC 6698, RFC 7671): server certificates checked against TLSA
+// records.  Only DANE-TA and DANE-EE records are used, and only when the
+// resolver says they were validated with DNSSEC; we don't validate
+// anything ourselves, so the resolver must be one we can trust, such as
+// one on localhost.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var daneFlag = flag.String("dane", "off",
+	"check certificates against DNSSEC-validated TLSA records: off, also (as well as the Web PKI), or only (instead of it)")
+
+// TLSA certificate usages we understand.
+const (
+	tlsaDANETA = 2
+	tlsaDANEEE = 3
+)
+
+// How long the lack of TLSA records, or a failure to look them up, is
+// remembered.
+const tlsaRetry = 30 * time.Second
+
+type tlsaRecord struct {
+	usage    uint8
+	selector uint8
+	mtype    uint8
+	data     []byte
+}
+
+type tlsaLookup struct {
+	recs  []tlsaRecord
+	err   error
+	until time.Time
+}
+
+var tlsaCache struct {
+	sync.Mutex
+	m map[string]tlsaLookup // by name
+}
+
+// lookupTLSA returns the usable TLSA records for a TLS service on host and
+// port.  Records that aren't authenticated are not usable.  Answers are
+// kept for as long as their TTL says.
+func lookupTLSA(host, port string) ([]tlsaRecord, error) {
+	name := "_" + port + "._tcp." + host
+	tlsaCache.Lock()
+	l, ok := tlsaCache.m[name]
+	tlsaCache.Unlock()
+	if ok && time.Now().Before(l.until) {
+		return l.recs, l.err
+	}
+
+	recs, ttl, err := queryTLSA(name)
+	l = tlsaLookup{recs, err, time.Now().Add(ttl)}
+	if err != nil || len(recs) == 0 {
+		l.until = time.Now().Add(tlsaRetry)
+	}
+	tlsaCache.Lock()
+	if tlsaCache.m == nil {
+		tlsaCache.m = make(map[string]tlsaLookup)
+	}
+	tlsaCache.m[name] = l
+	tlsaCache.Unlock()
+	return recs, err
+}
+
+// queryTLSA asks the DNS for the TLSA records of name, and returns the
+// usable ones along with the shortest TTL among them.
+func queryTLSA(name string) ([]tlsaRecord, time.Duration, error) {
+	r, err := dnsQuery(name, dnsTypeTLSA)
+	if err != nil {
+		return nil, 0, err
+	}
+	var recs []tlsaRecord
+	var ttl uint32
+	for _, rr := range r.answers {
+		if rr.typ != dnsTypeTLSA {
+			continue
+		}
+		if len(rr.data) < 3 {
+			return nil, 0, errDNSFormat
+		}
+		t := tlsaRecord{rr.data[0], rr.data[1], rr.data[2], rr.data[3:]}
+		if t.usage == tlsaDANETA || t.usage == tlsaDANEEE {
+			recs = append(recs, t)
+			if len(recs) == 1 || rr.ttl < ttl {
+				ttl = rr.ttl
+			}
+		}
+	}
+	if len(recs) > 0 && !r.ad {
+		fmt.Fprintln(os.Stderr, name+": TLSA records not authenticated by the resolver, ignoring them")
+		return nil, 0, nil
+	}
+	return recs, time.Duration(ttl) * time.Second, nil
+}
+
+// daneConfig adds DANE checks to cfg, for the TLSA records of host and
+// port.  cfg is left as it is if there are none.
+func daneConfig(cfg *tls.Config, host, port string) (*tls.Config, error) {
+	if *daneFlag == "off" || net.ParseIP(host) != nil {
+		return cfg, nil
+	}
+	recs, err := lookupTLSA(host, port)
+	if err != nil {
+		// Most likely a bogus answer from a validating resolver.
+		return nil, fmt.Errorf("%s: TLSA lookup: %w", host, err)
+	}
+	if len(recs) == 0 {
+		return cfg, nil
+	}
+
+	cfg = cfg.Clone()
+	// With "also", checks already there, such as for known hosts, are
+	// still done.  With "only", DANE stands in for the Web PKI and known
+	// hosts, but the certificate still has to be logged.
+	prev := cfg.VerifyConnection
+	if *daneFlag == "only" {
+		cfg.InsecureSkipVerify = true
+		prev = ctLogs.verify
+	}
+	name := cfg.ServerName
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if prev != nil {
+			if err := prev(cs); err != nil {
+				return certError(cs, err)
+			}
+		}
+		if err := verifyDANE(recs, cs.PeerCertificates, name); err != nil {
+			return certError(cs, fmt.Errorf("%s: DANE: %w", host, err))
+		}
+		return nil
+	}
+	return cfg, nil
+}
+
+func (t *tlsaRecord) matches(c *x509.Certificate) bool {
+	var b []byte
+	switch t.selector {
+	case 0:
+		b = c.Raw
+	case 1:
+		b = c.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch t.mtype {
+	case 0:
+	case 1:
+		h := sha256.Sum256(b)
+		b = h[:]
+	case 2:
+		h := sha512.Sum512(b)
+		b = h[:]
+	default:
+		return false
+	}
+	return bytes.Equal(b, t.data)
+}
+
+// verifyDANE checks the chain a server presented against its TLSA
+// records.  A DANE-EE record only has to match the server's certificate;
+// with DANE-TA, the certificate has to chain up to, and be issued for name
+// by, a trust anchor in the chain that matches.
+func verifyDANE(recs []tlsaRecord, certs []*x509.Certificate, name string) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate")
+	}
+	for _, t := range recs {
+		if t.usage == tlsaDANEEE {
+			if t.matches(certs[0]) {
+				return nil
+			}
+			continue
+		}
+		for i, ta := range certs[1:] {
+			if !t.matches(ta) {
+				continue
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(ta)
+			inter := x509.NewCertPool()
+			for _, c := range certs[1 : i+1] {
+				inter.AddCert(c)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       name,
+				Roots:         roots,
+				Intermediates: inter,
+			})
+			if err == nil {
+				return nil
+			}
+		}
+	}
+	return errors.New("no TLSA record matches the certificate chain")
+}
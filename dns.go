@@ -0,0 +1,363 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// A small DNS client for the record types the system resolver won't look
+// up for us.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var dnsFlag = flag.String("dns", "",
+	"DNS server for HTTPS, SVCB and TLSA lookups (default: from /etc/resolv.conf)")
+
+const (
+	dnsTypePTR   = 12
+	dnsTypeSRV   = 33
+	dnsTypeOPT   = 41
+	dnsTypeTLSA  = 52
+	dnsTypeHTTPS = 65
+
+	dnsClassIN = 1
+
+	dnsTimeout = 3 * time.Second
+)
+
+var errDNSFormat = errors.New("dns: malformed message")
+
+type dnsRR struct {
+	name  string
+	typ   uint16
+	class uint16
+	ttl   uint32
+	data  []byte
+	msg   []byte // the whole message, for names compressed in data
+	off   int    // of data in msg
+}
+
+type dnsReply struct {
+	id      uint16
+	flags   uint16
+	rcode   int
+	ad      bool    // authenticated data, as the server says
+	qs      []dnsRR // questions, with name, typ and class only
+	answers []dnsRR
+	extra   []dnsRR
+}
+
+// packName appends name in wire format to b.
+func packName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, l := range strings.Split(name, ".") {
+			if len(l) == 0 || len(l) > 63 {
+				return nil, fmt.Errorf("dns: bad name %q", name)
+			}
+			b = append(b, byte(len(l)))
+			b = append(b, l...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// readName reads a possibly compressed name at off in msg, and returns it
+// fully qualified along with the offset just past it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end, ptrs := -1, 0
+	for {
+		if off >= len(msg) {
+			return "", 0, errDNSFormat
+		}
+		c := int(msg[off])
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				return strings.Join(labels, ".") + ".", end, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, errDNSFormat
+			}
+			labels = append(labels, string(msg[off+1:off+1+c]))
+			off += 1 + c
+		case 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, errDNSFormat
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			if ptrs++; ptrs > 16 {
+				return "", 0, errDNSFormat
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			return "", 0, errDNSFormat
+		}
+	}
+}
+
+// dnsBuildQuery builds a query for name and typ with the given header
+// flags.  With edns, an OPT record asks for DNSSEC data as well.
+func dnsBuildQuery(id uint16, name string, typ, flags uint16, edns bool) ([]byte, error) {
+	var arcount uint16
+	if edns {
+		arcount = 1
+	}
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, arcount)
+
+	b, err := packName(b, name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+
+	if edns {
+		b = append(b, 0) // root
+		b = binary.BigEndian.AppendUint16(b, dnsTypeOPT)
+		b = binary.BigEndian.AppendUint16(b, 1232) // UDP payload size
+		b = append(b, 0, 0, 0x80, 0)               // DO bit
+		b = binary.BigEndian.AppendUint16(b, 0)
+	}
+	return b, nil
+}
+
+// appendRR appends a resource record to b.
+func appendRR(b []byte, name string, typ uint16, ttl uint32, data []byte) ([]byte, error) {
+	b, err := packName(b, name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...), nil
+}
+
+func readRR(msg []byte, off int) (dnsRR, int, error) {
+	var rr dnsRR
+	name, off, err := readName(msg, off)
+	if err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(msg) {
+		return rr, 0, errDNSFormat
+	}
+	rr.name = name
+	rr.typ = binary.BigEndian.Uint16(msg[off:])
+	rr.class = binary.BigEndian.Uint16(msg[off+2:])
+	rr.ttl = binary.BigEndian.Uint32(msg[off+4:])
+	n := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+n > len(msg) {
+		return rr, 0, errDNSFormat
+	}
+	rr.data = msg[off : off+n]
+	rr.msg = msg
+	rr.off = off
+	return rr, off + n, nil
+}
+
+func dnsParse(msg []byte) (*dnsReply, error) {
+	if len(msg) < 12 {
+		return nil, errDNSFormat
+	}
+	r := &dnsReply{
+		id:    binary.BigEndian.Uint16(msg),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	r.rcode = int(r.flags & 0xf)
+	r.ad = r.flags&0x20 != 0
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+	ns := int(binary.BigEndian.Uint16(msg[8:]))
+	ar := int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qd; i++ {
+		name, o, err := readName(msg, off)
+		if err != nil || o+4 > len(msg) {
+			return nil, errDNSFormat
+		}
+		r.qs = append(r.qs, dnsRR{
+			name:  name,
+			typ:   binary.BigEndian.Uint16(msg[o:]),
+			class: binary.BigEndian.Uint16(msg[o+2:]),
+		})
+		off = o + 4
+	}
+	for i := 0; i < an+ns+ar; i++ {
+		rr, o, err := readRR(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = o
+		switch {
+		case i < an:
+			r.answers = append(r.answers, rr)
+		case i >= an+ns:
+			r.extra = append(r.extra, rr)
+		}
+	}
+	return r, nil
+}
+
+// dnsServer picks the server to ask: -dns, or the first one in
+// resolv.conf.
+func dnsServer() string {
+	s := *dnsFlag
+	if s == "" {
+		s = "127.0.0.1"
+		if fp, err := os.Open("/etc/resolv.conf"); err == nil {
+			sc := bufio.NewScanner(fp)
+			for sc.Scan() {
+				f := strings.Fields(sc.Text())
+				if len(f) >= 2 && f[0] == "nameserver" {
+					s = f[1]
+					break
+				}
+			}
+			fp.Close()
+		}
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, "53")
+	}
+	return s
+}
+
+// dnsQuery asks the DNS server about name and typ, over UDP and then over
+// TCP if the answer didn't fit.
+func dnsQuery(name string, typ uint16) (*dnsReply, error) {
+	var idb [2]byte
+	rand.Read(idb[:])
+	id := binary.BigEndian.Uint16(idb[:])
+	// Recursion desired, and authenticated data if the server can vouch
+	// for it.
+	q, err := dnsBuildQuery(id, name, typ, 0x0120, true)
+	if err != nil {
+		return nil, err
+	}
+	server := dnsServer()
+
+	msg, err := dnsExchangeUDP(server, q, id)
+	if err != nil {
+		return nil, err
+	}
+	r, err := dnsParse(msg)
+	if err != nil {
+		return nil, err
+	}
+	if r.flags&0x0200 != 0 { // truncated
+		if msg, err = dnsExchangeTCP(server, q); err != nil {
+			return nil, err
+		}
+		if r, err = dnsParse(msg); err != nil {
+			return nil, err
+		}
+	}
+	if r.id != id {
+		return nil, errors.New("dns: reply ID mismatch")
+	}
+	if len(r.qs) != 1 || r.qs[0].typ != typ || r.qs[0].class != dnsClassIN ||
+		!strings.EqualFold(strings.TrimSuffix(r.qs[0].name, "."),
+			strings.TrimSuffix(name, ".")) {
+		return nil, fmt.Errorf("dns: %s: reply to another question", name)
+	}
+
+	switch r.rcode {
+	case 0:
+	case 3: // NXDOMAIN
+		r.answers = nil
+	default:
+		return nil, fmt.Errorf("dns: %s: server returned rcode %d",
+			name, r.rcode)
+	}
+	return r, nil
+}
+
+func dnsExchangeUDP(server string, q []byte, id uint16) ([]byte, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 65535)
+	for try := 0; try < 2; try++ {
+		conn.SetDeadline(time.Now().Add(dnsTimeout))
+		if _, err = conn.Write(q); err != nil {
+			return nil, err
+		}
+		for {
+			var n int
+			n, err = conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+				return buf[:n], nil
+			}
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("dns: %s: %w", server, err)
+}
+
+func dnsExchangeTCP(server string, q []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(q)))
+	if _, err = conn.Write(append(b, q...)); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err = io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err = io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testDNSAnswer struct {
+	typ  uint16
+	data []byte
+}
+
+// testDNSServer answers every query on a local UDP socket with what answer
+// gives for it, and points -dns at itself.  It returns the number of
+// queries so far.
+func testDNSServer(t *testing.T, answer func(q *dnsReply) (qname string, rcode int, ans []testDNSAnswer)) *atomic.Int32 {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	old := *dnsFlag
+	*dnsFlag = conn.LocalAddr().String()
+	t.Cleanup(func() { *dnsFlag = old })
+
+	var n atomic.Int32
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			l, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q, err := dnsParse(buf[:l])
+			if err != nil || len(q.qs) != 1 {
+				continue
+			}
+			n.Add(1)
+			qname, rcode, ans := answer(q)
+			b := binary.BigEndian.AppendUint16(nil, q.id)
+			b = binary.BigEndian.AppendUint16(b, 0x8180|uint16(rcode))
+			b = binary.BigEndian.AppendUint16(b, 1)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(ans)))
+			b = binary.BigEndian.AppendUint16(b, 0)
+			b = binary.BigEndian.AppendUint16(b, 0)
+			b, _ = packName(b, qname)
+			b = binary.BigEndian.AppendUint16(b, q.qs[0].typ)
+			b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+			for _, a := range ans {
+				b, _ = appendRR(b, qname, a.typ, 300, a.data)
+			}
+			conn.WriteTo(b, from)
+		}
+	}()
+	return &n
+}
+
+func TestDNSQuestionMismatch(t *testing.T) {
+	testDNSServer(t, func(q *dnsReply) (string, int, []testDNSAnswer) {
+		name := q.qs[0].name
+		if name == "evil.example." {
+			name = "other.example."
+		}
+		return name, 0, []testDNSAnswer{{dnsTypeTLSA, []byte{3, 1, 1, 0xaa}}}
+	})
+
+	r, err := dnsQuery("good.example", dnsTypeTLSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.answers) != 1 {
+		t.Errorf("got %d answers, expected 1", len(r.answers))
+	}
+	if _, err = dnsQuery("evil.example", dnsTypeTLSA); err == nil {
+		t.Error("reply to another question accepted")
+	}
+}
+
+func TestSVCBLookup(t *testing.T) {
+	rdata := binary.BigEndian.AppendUint16(nil, 1)
+	rdata, _ = packName(rdata, ".")
+	rdata = binary.BigEndian.AppendUint16(rdata, svcbALPN)
+	rdata = binary.BigEndian.AppendUint16(rdata, 3)
+	rdata = append(rdata, 2, 'h', '2')
+	rdata = binary.BigEndian.AppendUint16(rdata, svcbPort)
+	rdata = binary.BigEndian.AppendUint16(rdata, 2)
+	rdata = binary.BigEndian.AppendUint16(rdata, 8443)
+	testDNSServer(t, func(q *dnsReply) (string, int, []testDNSAnswer) {
+		return q.qs[0].name, 0, []testDNSAnswer{{dnsTypeHTTPS, rdata}}
+	})
+
+	d := &svcbDialer{records: make(map[string]svcbLookup)}
+	recs, err := d.lookup("example.com", "443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("got %d records, expected 1", len(recs))
+	}
+	r := recs[0]
+	if r.port != 8443 || r.target != "." {
+		t.Errorf("got target %q port %d", r.target, r.port)
+	}
+	if p := r.protos(); len(p) != 2 || p[0] != "h2" || p[1] != "http/1.1" {
+		t.Errorf("got protocols %q", p)
+	}
+}
+
+func TestSVCBNegativeCache(t *testing.T) {
+	n := testDNSServer(t, func(q *dnsReply) (string, int, []testDNSAnswer) {
+		return q.qs[0].name, 2, nil // SERVFAIL
+	})
+
+	d := &svcbDialer{records: make(map[string]svcbLookup)}
+	for i := 0; i < 3; i++ {
+		if _, err := d.lookup("example.com", "443"); err == nil {
+			t.Fatal("SERVFAIL taken for an answer")
+		}
+	}
+	if got := n.Load(); got != 1 {
+		t.Errorf("%d queries for one failed lookup", got)
+	}
+
+	l := d.records["example.com:443"]
+	l.until = time.Now().Add(-time.Second)
+	d.records["example.com:443"] = l
+	d.lookup("example.com", "443")
+	if got := n.Load(); got != 2 {
+		t.Errorf("failed lookup not retried once expired: %d queries", got)
+	}
+}
+
+// testSVCBRecord is the RDATA of a service-mode HTTPS record for target,
+// with the given port and ALPN protocols only.
+func testSVCBRecord(target string, port int, alpn ...string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, 1)
+	b, _ = packName(b, target)
+	var ids []byte
+	for _, a := range alpn {
+		ids = append(append(ids, byte(len(a))), a...)
+	}
+	b = binary.BigEndian.AppendUint16(b, svcbALPN)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(ids)))
+	b = append(b, ids...)
+	b = binary.BigEndian.AppendUint16(b, svcbNoDefaultALPN)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, svcbPort)
+	b = binary.BigEndian.AppendUint16(b, 2)
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// TestSVCBDial has example.com's HTTPS record send it to a local server,
+// on the port and with the protocol the record gives.
+func TestSVCBDial(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	_, p, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(p)
+
+	for _, c := range []struct {
+		alpn, proto string
+	}{
+		{"h2", "HTTP/2.0"},
+		// The server would rather speak HTTP/2, and so would goget
+		// without the record.
+		{"http/1.1", "HTTP/1.1"},
+	} {
+		rdata := testSVCBRecord("localhost.", port, c.alpn)
+		testDNSServer(t, func(q *dnsReply) (string, int, []testDNSAnswer) {
+			if q.qs[0].name != "example.com." {
+				return q.qs[0].name, 3, nil // NXDOMAIN
+			}
+			return q.qs[0].name, 0, []testDNSAnswer{{dnsTypeHTTPS, rdata}}
+		})
+		// The test certificate is for example.com.
+		cfg := srv.Client().Transport.(*http.Transport).TLSClientConfig
+		d := &svcbDialer{
+			tlsDialer: tlsDialer{tls: cfg, dial: (&net.Dialer{}).DialContext},
+			records:   make(map[string]svcbLookup),
+		}
+		tr := &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   cfg,
+			DialTLSContext:    d.dialTLS,
+		}
+		defer tr.CloseIdleConnections()
+		cl := &http.Client{Transport: &svcbUpgrader{d, tr}}
+
+		// Plain http is upgraded, as there is a record.
+		for _, u := range []string{"https://example.com/", "http://example.com/"} {
+			resp, err := cl.Get(u)
+			if err != nil {
+				t.Errorf("%s with ALPN %s: %v", u, c.alpn, err)
+				continue
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(b) != c.proto {
+				t.Errorf("%s with ALPN %s: got %s, expected %s",
+					u, c.alpn, b, c.proto)
+			}
+			if resp.Request.URL.Scheme != "https" {
+				t.Errorf("%s: not upgraded to https", u)
+			}
+		}
+	}
+}
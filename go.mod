@@ -1,3 +1,3 @@
 module git.manpager.org/goget
 
-go 1.21.6
+go 1.23
@@ -16,6 +16,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -23,11 +25,15 @@ import (
 	"io/fs"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 var qflag = flag.Bool("q", false, "be quiet")
 var pflag = flag.Int("p", 1, "number of parallel downloads")
+var lflag = flag.String("l", "wait",
+	"what to do about files locked by another goget: wait, skip or share")
 
 type filename struct {
 	n        int      // how many times the url has been accessed
@@ -38,60 +44,270 @@ type filename struct {
 // filemap maps URLs to corresponding filenames
 var filemap = make(map[string]filename)
 
-func getUrl(url, f string, ch chan int) {
+// commands maps subcommand names to their entry points.  Each gets the
+// arguments following its name.
+var commands = map[string]func(args []string) error{
+	"apt":     aptMain,
+	"audit":   auditMain,
+	"gomod":   gomodMain,
+	"mirrors": mirrorsMain,
+	"peers":   peersMain,
+	"tuf":     tufMain,
+}
+
+// statusError is returned for HTTP responses other than 200 OK.
+type statusError struct {
+	url    string
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return e.url + ": " + e.status
+}
+
+// fetchTo copies the body of url to w, failing if it is longer than max
+// bytes.
+func fetchTo(w io.Writer, url string, max int64) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{url, resp.StatusCode, resp.Status}
+	}
+	n, err := io.Copy(w, io.LimitReader(limitReader(resp.Body, url), max+1))
+	if err != nil {
+		return err
+	}
+	if n > max {
+		return fmt.Errorf("%s: longer than %d bytes", url, max)
+	}
+	return nil
+}
+
+// fetchBytes gets url into memory, failing if the body is longer than max
+// bytes.
+func fetchBytes(url string, max int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := fetchTo(&buf, url, max); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFileAtomic writes b to name via a temporary file in the same
+// directory, so that readers never see it half-written.
+func writeFileAtomic(name string, b []byte, perm fs.FileMode) error {
+	fp, err := os.CreateTemp(filepath.Dir(name), ".goget*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+
+	_, err = fp.Write(b)
+	if err == nil {
+		err = fp.Chmod(perm)
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), name)
+}
+
+func getUrl(url, f, name string, ch chan int) {
 	defer func() { ch <- 0 }()
 
+	start := time.Now()
+	class, skip, shared := "lock", false, false
+	var final string
+	var verified []string
+	var size int64
+	var digest []byte
+	var checked *checksum
+	var err error
+	s := spanFrom(context.Background()).child("download", spanInternal)
+	s.set("url.full", url)
+	s.set("file.path", name)
+	defer func() {
+		report.add(url, start, class, err, skip)
+		audit.add(url, final, name, size, digest, verified, shared, err)
+		prov.add(url, final, name, digest, checked, err)
+		s.finish(err)
+	}()
+
 	rm := func() {
 		os.Remove(f)
 	}
 
-	if !*qflag {
-		fmt.Println("GET", url)
+	lk, owner, err := lockOutput(name, url, false)
+	if errors.Is(err, errLocked) {
+		switch {
+		case *lflag == "skip":
+			fmt.Fprintln(os.Stderr, "skipping", name+":", err)
+			skip = true
+			rm()
+			return
+		case *lflag == "share" && owner == url:
+			// Somebody is already fetching the very same thing into
+			// the very same file, so just wait for them to finish.
+			if !*qflag {
+				fmt.Println("waiting for", name)
+			}
+			old, _ := os.Stat(name)
+			lk, _, err = lockOutput(name, url, true)
+			if err == nil {
+				// Only a file they renamed into place is theirs;
+				// one left from before means they failed.
+				if fi, serr := os.Stat(name); serr == nil &&
+					(old == nil || !os.SameFile(old, fi)) {
+					shared = true
+					unlockFile(lk, true)
+					rm()
+					return
+				}
+			}
+		default:
+			lk, _, err = lockOutput(name, url, true)
+		}
 	}
-
-	fp, err := os.Create(f)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		rm()
 		return
 	}
-	defer fp.Close()
-	fmt.Println("created", fp.Name())
+	defer unlockFile(lk, true)
 
-	resp, err := http.Get(url)
+	class = "download"
+	var sum *checksum
+	if (*checksumFlag || *peersFlag) && !isMQTT(url) {
+		sum, err = findChecksum(url)
+		if err != nil && !*checksumFlag {
+			// The sum was only wanted for asking peers.
+			fmt.Fprintln(os.Stderr, err)
+			sum, err = nil, nil
+		}
+	}
+	if err == nil {
+		final = peerFetch(url, f, sum)
+	}
+	if err == nil && final == "" {
+		final, err = download(withSpan(context.Background(), s), url, f)
+	}
+	if err == nil && sigstore != nil {
+		class = "verify"
+		if err = sigstore.verifyFile(url, f); err == nil {
+			verified = append(verified, "sigstore")
+		}
+	}
+	if err == nil && *checksumFlag {
+		class = "verify"
+		err = verifyChecksum(url, f, sum)
+		if err == nil && sum != nil {
+			verified = append(verified, sum.kind.name)
+			checked = sum
+		}
+	}
+	// Rename while still holding the lock, so that nobody else can
+	// see a half-written file under the final name.
+	if err == nil {
+		class = "rename"
+		size, digest, err = hashOutput(f)
+	}
+	if err == nil {
+		err = os.Rename(f, name)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		rm()
 		return
 	}
+	if *peersFlag {
+		if err := peerCacheAdd(name); err != nil {
+			fmt.Fprintln(os.Stderr, "peer cache:", err)
+		}
+	}
+}
+
+// hashOutput gives the size and SHA-256 of the download f, for the audit
+// log and provenance.  It is done before f is put in place and unlocked,
+// as after that, another goget may replace it.
+func hashOutput(f string) (int64, []byte, error) {
+	if audit == nil && prov == nil {
+		return 0, nil, nil
+	}
+	fi, err := os.Stat(f)
+	if err != nil {
+		return 0, nil, err
+	}
+	sum, err := fileSHA256(f)
+	return fi.Size(), sum, err
+}
+
+// download fetches url into the file f, and returns the URL it ended up
+// at after any redirects.
+func download(ctx context.Context, url, f string) (string, error) {
+	if isMQTT(url) {
+		return url, mqttCapture(ctx, url, f)
+	}
+	if !*qflag {
+		fmt.Println("GET", url)
+	}
+
+	fp, err := os.Create(f)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	fmt.Println("created", fp.Name())
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	final := resp.Request.URL.String()
+	if resp.StatusCode != http.StatusOK {
+		return final, &statusError{url, resp.StatusCode, resp.Status}
+	}
+
+	pipe, err := startPipe(url)
+	if err != nil {
+		return final, err
+	}
 	buf := make([]byte, 4096)
-	reader := bufio.NewReader(resp.Body)
-	writer := bufio.NewWriter(fp)
+	reader := bufio.NewReader(limitReader(resp.Body, url))
+	writer := bufio.NewWriter(pipe.tee(fp))
 
-	for readErr := error(nil); readErr == nil; {
+	for {
 		n, readErr := io.ReadFull(reader, buf)
 		if readErr == io.EOF {
 			break
 		}
 		if readErr != nil && readErr != io.ErrUnexpectedEOF {
-			fmt.Fprintln(os.Stderr, readErr)
-			rm()
-			break
+			return final, pipe.finish(readErr)
 		}
 
 		_, writeErr := writer.Write(buf[:n])
 		if writeErr != nil {
-			fmt.Fprintln(os.Stderr, writeErr)
-			rm()
-			break
+			return final, pipe.finish(writeErr)
 		}
 	}
-	writer.Flush()
+	return final, pipe.finish(writer.Flush())
 }
 
 func prepUrl(url, d string) (string, error) {
-	if !(strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) {
+	if !(strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") ||
+		isMQTT(url)) {
 		url = "http://" + url
 	}
 
@@ -104,7 +320,9 @@ func prepUrl(url, d string) (string, error) {
 	_, fname, _ = strings.Cut(fname, "/")
 	parts := strings.Split(fname, "/")
 	fname = parts[len(parts)-1]
-	if fname == "" {
+	if isMQTT(url) {
+		fname = mqttFileName(url)
+	} else if fname == "" {
 		fname = "index.html"
 	}
 
@@ -123,10 +341,78 @@ func prepUrl(url, d string) (string, error) {
 func main() {
 	flag.Parse()
 
+	l, err := newLimiter(*rflag, *wflag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	limit = l
+	if client, err = newClient(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if *otlpFlag != "" {
+		name := "goget"
+		if ok {
+			name += " " + flag.Arg(0)
+		}
+		tracer = newTracer(*otlpFlag, name)
+	}
+	if ok {
+		err := cmd(flag.Args()[1:])
+		if terr := tracer.finish(err); terr != nil {
+			fmt.Fprintln(os.Stderr, "otlp:", terr)
+		}
+		if serr := sessions.save(); serr != nil {
+			fmt.Fprintln(os.Stderr, "tls sessions:", serr)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *pflag < 1 {
 		fmt.Fprintln(os.Stderr, "can't do less than 1 parallel downloads")
 		os.Exit(1)
 	}
+	switch *lflag {
+	case "wait", "skip", "share":
+	default:
+		fmt.Fprintln(os.Stderr, "unknown lock mode:", *lflag)
+		os.Exit(1)
+	}
+	if *sigstoreRootFlag != "" {
+		p, err := newSigstorePolicy(*sigstoreRootFlag,
+			*sigstoreIdentityFlag, *sigstoreIssuerFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sigstore = p
+	}
+	if *junitFlag != "" {
+		report = &junitReport{start: time.Now()}
+	}
+	if *auditFlag != "" {
+		audit = newAuditLog(*auditFlag)
+	}
+	if *provenanceFlag != "" {
+		p, err := newProvenance(*provenanceKeyFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		prov = p
+	}
+	if *peersFlag {
+		if err := servePeers(":0"); err != nil {
+			fmt.Fprintln(os.Stderr, "peers:", err)
+		}
+	}
 
 	var urls []string
 
@@ -136,27 +422,6 @@ func main() {
 		os.Exit(1)
 	}
 	defer func() {
-		rename := func(url string) {
-			fentry := filemap[url]
-			defer func() {
-				fentry.tmpfiles = fentry.tmpfiles[1:]
-				filemap[url] = fentry
-			}()
-			os.Rename(fentry.tmpfiles[0], fentry.name)
-			// Ignoring ErrNotExist since the temporary file might
-			// have been removed on purpose.
-			//
-			// TODO It would be better to have such purposeful
-			// removals marked explicitly.
-			if err != nil && !errors.Is(err, fs.ErrNotExist) {
-				fmt.Fprintln(os.Stderr, err)
-			}
-		}
-
-		for _, url := range urls {
-			rename(url)
-		}
-
 		err := os.Remove(tmpdir)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -181,7 +446,7 @@ func main() {
 			routines--
 		}
 		if fmentry, ok := filemap[url]; ok {
-			go getUrl(url, fmentry.tmpfiles[fmentry.n], ch)
+			go getUrl(url, fmentry.tmpfiles[fmentry.n], fmentry.name, ch)
 			fmentry.n++
 			filemap[url] = fmentry
 			routines++
@@ -192,4 +457,23 @@ func main() {
 		<-ch
 		routines--
 	}
+
+	if err := tracer.finish(nil); err != nil {
+		fmt.Fprintln(os.Stderr, "otlp:", err)
+	}
+	if err := sessions.save(); err != nil {
+		fmt.Fprintln(os.Stderr, "tls sessions:", err)
+	}
+	if report != nil {
+		if err := report.write(*junitFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if prov != nil {
+		if err := prov.write(*provenanceFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 }
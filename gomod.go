@@ -0,0 +1,681 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// A client for the Go module proxy protocol, which lays modules out the
+// way the go command does in its module cache, so that builds can be done
+// offline with GOPROXY=file://$GOMODCACHE/cache/download or GOFLAGS=-mod=mod.
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	gomodMaxMod = 16 << 20
+	gomodMaxZip = 500 << 20
+)
+
+// Verifier keys of the checksum databases we know of.
+var knownSumdbs = map[string]string{
+	"sum.golang.org": "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8",
+}
+
+// modEscape escapes a module path or version for use in URLs and file
+// names: upper-case letters become an exclamation mark followed by the
+// letter's lower-case form.
+func modEscape(s string) (string, error) {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '!' || r >= utf8.RuneSelf:
+			return "", fmt.Errorf("%q: bad character in module path", s)
+		case 'A' <= r && r <= 'Z':
+			b.WriteByte('!')
+			b.WriteRune(r + 'a' - 'A')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), nil
+}
+
+// isNum tells whether s is a decimal number without leading zeros.
+func isNum(s string) bool {
+	if s == "" || (len(s) > 1 && s[0] == '0') {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalVersion tells whether v is a semantic version in the canonical
+// form module versions take: vMAJOR.MINOR.PATCH, maybe with a pre-release,
+// and no build metadata but +incompatible.  Such a version is safe to use
+// in a file name.
+func canonicalVersion(v string) bool {
+	v, ok := strings.CutPrefix(v, "v")
+	if !ok {
+		return false
+	}
+	v, _ = strings.CutSuffix(v, "+incompatible")
+	v, pre, hasPre := strings.Cut(v, "-")
+	f := strings.Split(v, ".")
+	if len(f) != 3 || !isNum(f[0]) || !isNum(f[1]) || !isNum(f[2]) {
+		return false
+	}
+	if !hasPre {
+		return true
+	}
+	for _, id := range strings.Split(pre, ".") {
+		if id == "" {
+			return false
+		}
+		num := true
+		for _, r := range id {
+			switch {
+			case '0' <= r && r <= '9':
+			case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', r == '-':
+				num = false
+			default:
+				return false
+			}
+		}
+		if num && !isNum(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// hash1 is the "h1:" hash of go.sum: a SHA-256 over a sorted list of the
+// SHA-256 hashes of the files named.
+func hash1(names []string, open func(string) (io.ReadCloser, error)) (string, error) {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	for _, name := range sorted {
+		if strings.Contains(name, "\n") {
+			return "", fmt.Errorf("%q: file name with a newline", name)
+		}
+		r, err := open(name)
+		if err != nil {
+			return "", err
+		}
+		fh := sha256.New()
+		_, err = io.Copy(fh, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%x  %s\n", fh.Sum(nil), name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashGoMod(b []byte) (string, error) {
+	return hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+}
+
+// hashZip checks that every file of a module zip is under mod@ver/, and
+// returns the hash of the zip.
+func hashZip(name, mod, ver string) (string, error) {
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		return "", err
+	}
+	defer z.Close()
+
+	prefix := mod + "@" + ver + "/"
+	files := make(map[string]*zip.File)
+	var names []string
+	for _, f := range z.File {
+		if !strings.HasPrefix(f.Name, prefix) {
+			return "", fmt.Errorf("%s: %s outside of %s", name, f.Name, prefix)
+		}
+		if _, ok := files[f.Name]; ok {
+			return "", fmt.Errorf("%s: duplicate %s", name, f.Name)
+		}
+		files[f.Name] = f
+		names = append(names, f.Name)
+	}
+	return hash1(names, func(name string) (io.ReadCloser, error) {
+		return files[name].Open()
+	})
+}
+
+// readGoSum reads go.sum lines into a map from "mod ver" and
+// "mod ver/go.mod" to their hashes.
+func readGoSum(name string, sums map[string]string) error {
+	fp, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	s := bufio.NewScanner(fp)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) == 3 {
+			sums[f[0]+" "+f[1]] = f[2]
+		}
+	}
+	return s.Err()
+}
+
+type sumdb struct {
+	url   string
+	key   ed25519.PublicKey
+	tiles map[string][]byte
+}
+
+// newSumdb takes a database as GOSUMDB names it: a verifier key, or a known
+// database name, optionally followed by its URL.
+func newSumdb(spec string) (*sumdb, error) {
+	f := strings.Fields(spec)
+	if len(f) == 0 || len(f) > 2 {
+		return nil, fmt.Errorf("%q: bad checksum database", spec)
+	}
+	vkey := f[0]
+	if k, ok := knownSumdbs[vkey]; ok {
+		vkey = k
+	}
+
+	parts := strings.SplitN(vkey, "+", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%q: bad verifier key", vkey)
+	}
+	name := parts[0]
+	hint, err1 := strconv.ParseUint(parts[1], 16, 32)
+	key, err2 := base64.StdEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || len(key) != 1+ed25519.PublicKeySize ||
+		key[0] != 1 {
+		return nil, fmt.Errorf("%q: bad verifier key", vkey)
+	}
+	h := sha256.Sum256(append([]byte(name+"\n"), key...))
+	if binary.BigEndian.Uint32(h[:4]) != uint32(hint) {
+		return nil, fmt.Errorf("%q: key hash mismatch", vkey)
+	}
+
+	db := &sumdb{
+		url:   "https://" + name,
+		key:   ed25519.PublicKey(key[1:]),
+		tiles: make(map[string][]byte),
+	}
+	if len(f) == 2 {
+		db.url = strings.TrimSuffix(f[1], "/")
+	}
+	return db, nil
+}
+
+// tile fetches the tile at level l, index n, w hashes wide.  Tiles are 2^8
+// hashes wide when full.
+func (db *sumdb) tile(l int, n, w uint64) ([]byte, error) {
+	s := fmt.Sprintf("%03d", n%1000)
+	for n >= 1000 {
+		n /= 1000
+		s = fmt.Sprintf("x%03d/", n%1000) + s
+	}
+	full := fmt.Sprintf("/tile/8/%d/%s", l, s)
+
+	// Hashes never change once written, so a full tile, if there is
+	// one by now, will do just as well as a partial one.
+	if b, ok := db.tiles[full]; ok {
+		return b, nil
+	}
+	if w < 256 {
+		partial := full + fmt.Sprintf(".p/%d", w)
+		b, err := db.fetchTile(partial, w)
+		var serr *statusError
+		if !errors.As(err, &serr) || serr.code != 404 {
+			return b, err
+		}
+	}
+	return db.fetchTile(full, 256)
+}
+
+func (db *sumdb) fetchTile(path string, w uint64) ([]byte, error) {
+	if b, ok := db.tiles[path]; ok {
+		return b, nil
+	}
+	b, err := fetchBytes(db.url+path, int64(w)*sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b)) != w*sha256.Size {
+		return nil, fmt.Errorf("%s: short tile", path)
+	}
+	db.tiles[path] = b
+	return b, nil
+}
+
+// subtree returns the hash of the complete subtree of height h and index k
+// in a tree of size n, from the tiles storing it.
+func (db *sumdb) subtree(h int, k, n uint64) ([]byte, error) {
+	l, r := h/8, h%8
+	first := k << uint(r)
+	t := first / 256
+	w := (n >> uint(8*l)) - t*256
+	if w > 256 {
+		w = 256
+	}
+	b, err := db.tile(l, t, w)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes [][]byte
+	for i := first % 256; i < first%256+1<<uint(r); i++ {
+		if (i+1)*sha256.Size > uint64(len(b)) {
+			return nil, errors.New("tile too short for subtree")
+		}
+		hashes = append(hashes, b[i*sha256.Size:(i+1)*sha256.Size])
+	}
+	for len(hashes) > 1 {
+		for i := 0; i < len(hashes)/2; i++ {
+			hashes[i] = nodeHash(hashes[2*i], hashes[2*i+1])
+		}
+		hashes = hashes[:len(hashes)/2]
+	}
+	return hashes[0], nil
+}
+
+// rangeHash is the RFC 6962 hash of leaves lo to hi, as part of a tree of
+// size n.
+func (db *sumdb) rangeHash(lo, hi, n uint64) ([]byte, error) {
+	size := hi - lo
+	if size&(size-1) == 0 && lo%size == 0 {
+		h := bits.TrailingZeros64(size)
+		return db.subtree(h, lo>>uint(h), n)
+	}
+	k := uint64(1) << uint(bits.Len64(size-1)-1)
+	l, err := db.rangeHash(lo, lo+k, n)
+	if err != nil {
+		return nil, err
+	}
+	r, err := db.rangeHash(lo+k, hi, n)
+	if err != nil {
+		return nil, err
+	}
+	return nodeHash(l, r), nil
+}
+
+// proof builds the RFC 6962 inclusion proof for leaf m of leaves lo to hi.
+func (db *sumdb) proof(m, lo, hi, n uint64) ([][]byte, error) {
+	if hi-lo == 1 {
+		return nil, nil
+	}
+	k := uint64(1) << uint(bits.Len64(hi-lo-1)-1)
+	var p [][]byte
+	var h []byte
+	var err error
+	if m < lo+k {
+		if p, err = db.proof(m, lo, lo+k, n); err == nil {
+			h, err = db.rangeHash(lo+k, hi, n)
+		}
+	} else {
+		if p, err = db.proof(m, lo+k, hi, n); err == nil {
+			h, err = db.rangeHash(lo, lo+k, n)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(p, h), nil
+}
+
+// lookup gets the go.sum lines for mod@ver from the database, and checks
+// that they are in the signed tree.
+func (db *sumdb) lookup(mod, ver string, sums map[string]string) error {
+	emod, err := modEscape(mod)
+	if err != nil {
+		return err
+	}
+	ever, err := modEscape(ver)
+	if err != nil {
+		return err
+	}
+	b, err := fetchBytes(db.url+"/lookup/"+emod+"@"+ever, 1<<20)
+	if err != nil {
+		return err
+	}
+
+	idline, rest, _ := strings.Cut(string(b), "\n")
+	id, err := strconv.ParseUint(idline, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s@%s: bad lookup record", mod, ver)
+	}
+	i := strings.Index(rest, "\n\n")
+	if i < 0 {
+		return fmt.Errorf("%s@%s: bad lookup record", mod, ver)
+	}
+	text, note := rest[:i+1], rest[i+2:]
+
+	_, size, root, err := verifyCheckpoint(note, db.key)
+	if err != nil {
+		return err
+	}
+	if id >= size {
+		return fmt.Errorf("%s@%s: record %d not in tree of %d",
+			mod, ver, id, size)
+	}
+	p, err := db.proof(id, 0, size, size)
+	if err != nil {
+		return err
+	}
+	err = verifyInclusion(id, size, leafHash([]byte(text)), p, root)
+	if err != nil {
+		return fmt.Errorf("%s@%s: %w", mod, ver, err)
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 3 && f[0] == mod {
+			sums[f[0]+" "+f[1]] = f[2]
+		}
+	}
+	return nil
+}
+
+type gomodClient struct {
+	proxy string
+	cache string // cache/download in the module cache
+	sums  map[string]string
+	db    *sumdb
+}
+
+func (c *gomodClient) get(mod, path string, max int64) ([]byte, error) {
+	u := c.proxy + "/" + mod + "/@" + path
+	if !*qflag {
+		fmt.Println("GET", u)
+	}
+	return fetchBytes(u, max)
+}
+
+func (c *gomodClient) list(mod string) ([]string, error) {
+	emod, err := modEscape(mod)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.get(emod, "v/list", 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	var vers []string
+	for _, v := range strings.Split(string(b), "\n") {
+		if v = strings.TrimSpace(v); v != "" {
+			vers = append(vers, v)
+		}
+	}
+	return vers, nil
+}
+
+// verify compares the computed hashes of mod@ver with go.sum, and the
+// checksum database for what go.sum doesn't have.
+func (c *gomodClient) verify(mod, ver, modHash, zipHash string) error {
+	key := mod + " " + ver
+	_, ok1 := c.sums[key]
+	_, ok2 := c.sums[key+"/go.mod"]
+	switch {
+	case ok1 && ok2:
+	case c.db != nil:
+		sums := make(map[string]string)
+		if err := c.db.lookup(mod, ver, sums); err != nil {
+			return err
+		}
+		for k, h := range sums {
+			if _, ok := c.sums[k]; !ok {
+				c.sums[k] = h
+			}
+		}
+	case !ok1 && !ok2:
+		fmt.Fprintln(os.Stderr, "warning:", mod+"@"+ver,
+			"not verified: no go.sum entry and no checksum database")
+		return nil
+	}
+
+	for k, h := range map[string]string{key: zipHash, key + "/go.mod": modHash} {
+		want, ok := c.sums[k]
+		if !ok {
+			return fmt.Errorf("%s: missing checksum", k)
+		}
+		if want != h {
+			return fmt.Errorf("%s: checksum mismatch\n\tdownloaded: %s\n\texpected:   %s",
+				k, h, want)
+		}
+	}
+	return nil
+}
+
+// download fetches mod@ver, where ver may be "latest", into the cache.
+func (c *gomodClient) download(mod, ver string) error {
+	emod, err := modEscape(mod)
+	if err != nil {
+		return err
+	}
+	if ver == "" || ver == "latest" {
+		b, err := c.get(emod, "latest", 1<<20)
+		if err != nil {
+			return err
+		}
+		var info struct{ Version string }
+		if err = json.Unmarshal(b, &info); err != nil {
+			return fmt.Errorf("%s@latest: %w", mod, err)
+		}
+		ver = info.Version
+	}
+	// The version may have come from the proxy, and goes into file
+	// names.
+	if !canonicalVersion(ver) {
+		return fmt.Errorf("%s@%q: not a canonical version", mod, ver)
+	}
+	ever, err := modEscape(ver)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(c.cache, filepath.FromSlash(emod), "@v")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// Same lock file as the go command's, which uses flock(2) as well.
+	lk, err := lockFile(filepath.Join(dir, ever+".lock"), 0666, true)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lk, false)
+
+	info, err := c.get(emod, "v/"+ever+".info", 1<<20)
+	if err != nil {
+		return err
+	}
+	gomod, err := c.get(emod, "v/"+ever+".mod", gomodMaxMod)
+	if err != nil {
+		return err
+	}
+
+	u := c.proxy + "/" + emod + "/@v/" + ever + ".zip"
+	if !*qflag {
+		fmt.Println("GET", u)
+	}
+	fp, err := os.CreateTemp(dir, ever+".zip*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	err = fetchTo(fp, u, gomodMaxZip)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	modHash, err := hashGoMod(gomod)
+	if err != nil {
+		return err
+	}
+	zipHash, err := hashZip(fp.Name(), mod, ver)
+	if err != nil {
+		return err
+	}
+	if err = c.verify(mod, ver, modHash, zipHash); err != nil {
+		return err
+	}
+
+	base := filepath.Join(dir, ever)
+	if err = writeFileAtomic(base+".info", info, 0644); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(base+".mod", gomod, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(fp.Name(), base+".zip"); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(base+".ziphash", []byte(zipHash), 0644); err != nil {
+		return err
+	}
+	if !*qflag {
+		fmt.Println("downloaded", mod+"@"+ver)
+	}
+	return addToList(filepath.Join(dir, "list"), ver)
+}
+
+// addToList records ver in the list file the go command serves when the
+// cache is used as a proxy.
+func addToList(name, ver string) error {
+	b, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, v := range strings.Split(string(b), "\n") {
+		if v == ver {
+			return nil
+		}
+	}
+	return writeFileAtomic(name, append(b, ver+"\n"...), 0644)
+}
+
+func defaultModCache() string {
+	if s := os.Getenv("GOMODCACHE"); s != "" {
+		return s
+	}
+	if s := filepath.SplitList(os.Getenv("GOPATH")); len(s) > 0 && s[0] != "" {
+		return filepath.Join(s[0], "pkg", "mod")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "go", "pkg", "mod")
+}
+
+func defaultProxy() string {
+	for _, p := range strings.FieldsFunc(os.Getenv("GOPROXY"), func(r rune) bool {
+		return r == ',' || r == '|'
+	}) {
+		if p != "direct" && p != "off" {
+			return p
+		}
+	}
+	return "https://proxy.golang.org"
+}
+
+func defaultSumdb() string {
+	if s := os.Getenv("GOSUMDB"); s != "" {
+		return s
+	}
+	return "sum.golang.org"
+}
+
+func gomodMain(args []string) error {
+	fs := flag.NewFlagSet("gomod", flag.ExitOnError)
+	proxyFlag := fs.String("proxy", defaultProxy(), "module proxy URL")
+	oflag := fs.String("o", defaultModCache(), "module cache directory")
+	sumFlag := fs.String("sum", "", "go.sum file to verify against")
+	sumdbFlag := fs.String("sumdb", defaultSumdb(),
+		"checksum database key and URL, as in GOSUMDB, or off")
+	listFlag := fs.Bool("list", false, "list the versions of modules instead")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),
+			"usage: goget gomod [options] module[@version] ...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	c := &gomodClient{
+		proxy: strings.TrimSuffix(*proxyFlag, "/"),
+		cache: filepath.Join(*oflag, "cache", "download"),
+		sums:  make(map[string]string),
+	}
+	if *sumFlag != "" {
+		if err := readGoSum(*sumFlag, c.sums); err != nil {
+			return err
+		}
+	}
+	if *sumdbFlag != "off" {
+		db, err := newSumdb(*sumdbFlag)
+		if err != nil {
+			return err
+		}
+		c.db = db
+	}
+
+	failed := false
+	for _, arg := range fs.Args() {
+		mod, ver, _ := strings.Cut(arg, "@")
+		var err error
+		if *listFlag {
+			var vers []string
+			if vers, err = c.list(mod); err == nil {
+				for _, v := range vers {
+					fmt.Println(mod, v)
+				}
+			}
+		} else {
+			err = c.download(mod, ver)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("some modules failed")
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// JUnit XML reports, with a test case for every download, for CI systems
+// to show.
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+var junitFlag = flag.String("report-junit", "",
+	"write a JUnit XML report of the downloads to this file")
+
+// report collects the results of downloads, if a report was asked for.
+var report *junitReport
+
+type junitReport struct {
+	start time.Time
+
+	mu    sync.Mutex
+	cases []junitCase
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Skipped   *junitSkipped `xml:"skipped"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// add records the download of u, begun at start.  class says what was
+// being done when err happened, unless it was an HTTP, TLS or network
+// error.  With skip, err is why the download was skipped.
+func (r *junitReport) add(u string, start time.Time, class string, err error, skip bool) {
+	if r == nil {
+		return
+	}
+	c := junitCase{
+		Name:      u,
+		Classname: u,
+		Time:      seconds(time.Since(start)),
+	}
+	if pu, perr := url.Parse(u); perr == nil {
+		c.Classname = pu.Host
+	}
+	switch {
+	case skip:
+		c.Skipped = &junitSkipped{err.Error()}
+	case err != nil:
+		f := &junitFailure{Message: err.Error(), Type: errorClass(err, class)}
+		var serr *statusError
+		if errors.As(err, &serr) {
+			f.Text = "HTTP status: " + serr.status
+		}
+		c.Failure = f
+	}
+
+	r.mu.Lock()
+	r.cases = append(r.cases, c)
+	r.mu.Unlock()
+}
+
+// errorClass tells what kind of error err is, or gives class if it can't.
+// Every error from an HTTP request is a url.Error, and a net.Error with
+// it, so it's what it wraps that counts.
+func errorClass(err error, class string) string {
+	var serr *statusError
+	if errors.As(err, &serr) {
+		return "http"
+	}
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		err = uerr.Err
+	}
+	var (
+		cerr   *tls.CertificateVerificationError
+		rerr   tls.RecordHeaderError
+		aerr   tls.AlertError
+		echerr *tls.ECHRejectionError
+		operr  *net.OpError
+		dnserr *net.DNSError
+	)
+	switch {
+	case errors.As(err, &cerr), errors.As(err, &rerr),
+		errors.As(err, &aerr), errors.As(err, &echerr):
+		return "tls"
+	case errors.As(err, &operr), errors.As(err, &dnserr),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, context.DeadlineExceeded):
+		return "network"
+	}
+	return class
+}
+
+func (r *junitReport) write(name string) error {
+	s := junitSuite{
+		Name:      "goget",
+		Tests:     len(r.cases),
+		Time:      seconds(time.Since(r.start)),
+		Timestamp: r.start.UTC().Format("2006-01-02T15:04:05"),
+		Cases:     r.cases,
+	}
+	for _, c := range r.cases {
+		switch {
+		case c.Failure != nil:
+			s.Failures++
+		case c.Skipped != nil:
+			s.Skipped++
+		}
+	}
+	b, err := xml.MarshalIndent(junitSuites{Suites: []junitSuite{s}}, "", "\t")
+	if err != nil {
+		return err
+	}
+	b = append([]byte(xml.Header), b...)
+	return os.WriteFile(name, append(b, '\n'), 0644)
+}
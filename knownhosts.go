@@ -0,0 +1,187 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Trust on first use, as in SSH, for servers with certificates nobody
+// vouches for.  A server in the known hosts file has to present the same
+// public key as when it was first seen, whatever its certificate says.
+// One that isn't there is checked against the Web PKI as usual, and if
+// that fails, its key is recorded, with the user's consent or with
+// -accept-new.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+var knownHostsFlag = flag.String("known-hosts", "",
+	"pin the keys of servers with untrusted certificates in this file on first use, and check them afterwards")
+var acceptNewFlag = flag.Bool("accept-new", false,
+	"with -known-hosts, record the keys of new servers without asking")
+
+// hostKeys is the -known-hosts file, if there is one.
+var hostKeys *knownHosts
+
+type knownHosts struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[string]string // fingerprint by host:port
+}
+
+// fingerprint is the SHA-256 of the certificate's public key, in the
+// format OpenSSH uses.
+func fingerprint(c *x509.Certificate) string {
+	h := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(h[:])
+}
+
+// loadKnownHosts reads the file of "host:port fingerprint" lines.
+func loadKnownHosts(path string) (*knownHosts, error) {
+	kh := &knownHosts{path: path, keys: make(map[string]string)}
+	fp, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return kh, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	sc := bufio.NewScanner(fp)
+	for n := 1; sc.Scan(); n++ {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 || f[0][0] == '#' {
+			continue
+		}
+		if len(f) != 2 || !strings.HasPrefix(f[1], "SHA256:") {
+			return nil, fmt.Errorf("%s:%d: bad line", path, n)
+		}
+		kh.keys[strings.ToLower(f[0])] = f[1]
+	}
+	return kh, sc.Err()
+}
+
+// config returns a copy of cfg that checks the server at addr, the
+// host:port dialed, against kh.  With no known hosts, cfg is returned as
+// it is.
+func (kh *knownHosts) config(cfg *tls.Config, addr string) *tls.Config {
+	if kh == nil {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	cfg.InsecureSkipVerify = true
+	prev := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := kh.verify(addr, cs); err != nil {
+			return certError(cs, err)
+		}
+		if prev != nil {
+			return prev(cs)
+		}
+		return nil
+	}
+	return cfg
+}
+
+// verify checks the server at addr, which has to have presented the key
+// recorded for it, or else a certificate valid for its host.
+func (kh *knownHosts) verify(addr string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no certificate")
+	}
+	name, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	host := strings.ToLower(addr)
+	leaf := cs.PeerCertificates[0]
+	fp := fingerprint(leaf)
+
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+	if known, ok := kh.keys[host]; ok {
+		if fp != known {
+			return fmt.Errorf("%s: KEY MISMATCH: the server's key is %s, but %s says it should be %s; it may be an impostor",
+				host, fp, kh.path, known)
+		}
+		return nil
+	}
+
+	inter := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Intermediates: inter,
+	})
+	if err == nil {
+		return nil
+	}
+	if !*acceptNewFlag {
+		if aerr := askTrust(host, fp, err); aerr != nil {
+			return aerr
+		}
+	}
+	return kh.add(host, fp)
+}
+
+// askTrust asks the user on the terminal whether to trust host.
+func askTrust(host, fp string, verr error) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("%s: %w (and no terminal to ask about %s on; see -accept-new)",
+			host, verr, fp)
+	}
+	defer tty.Close()
+	fmt.Fprintf(tty, "%s: %v\nIts key fingerprint is %s.\nTrust it from now on (yes/no)? ",
+		host, verr, fp)
+	line, _ := bufio.NewReader(tty).ReadString('\n')
+	if strings.TrimSpace(strings.ToLower(line)) != "yes" {
+		return fmt.Errorf("%s: %w", host, verr)
+	}
+	return nil
+}
+
+// add records fp for host.  kh.mu is held.
+func (kh *knownHosts) add(host, fp string) error {
+	f, err := os.OpenFile(kh.path,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, host, fp)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	kh.keys[host] = fp
+	fmt.Fprintf(os.Stderr, "added %s with key %s to %s\n",
+		host, fp, kh.path)
+	return nil
+}
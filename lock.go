@@ -0,0 +1,93 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errLocked = errors.New("locked by another process")
+
+// lockFile opens path, creating it with perm if needed, and takes an
+// exclusive advisory lock on it.  Unless wait is set, errLocked is returned
+// right away if someone else holds the lock.
+func lockFile(path string, perm fs.FileMode, wait bool) (*os.File, error) {
+	for {
+		fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, perm)
+		if err != nil {
+			return nil, err
+		}
+		if err = flock(fp, wait); err != nil {
+			fp.Close()
+			return nil, err
+		}
+
+		// The previous holder might have removed the file while we
+		// were waiting for it, in which case we've locked nothing.
+		fi, err := fp.Stat()
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		if pi, err := os.Stat(path); err == nil && os.SameFile(fi, pi) {
+			return fp, nil
+		}
+		fp.Close()
+	}
+}
+
+// unlockFile releases a lock taken by lockFile.  Lock files that only exist
+// for the sake of locking should be removed, which has to be done before
+// the lock is let go of.
+func unlockFile(fp *os.File, remove bool) {
+	if remove {
+		os.Remove(fp.Name())
+	}
+	fp.Close()
+}
+
+func outLockPath(name string) string {
+	dir, file := filepath.Split(name)
+	return filepath.Join(dir, "."+file+".goget-lock")
+}
+
+// lockOutput locks the output file name against other goget processes.
+// The lock file holds the URL being fetched, so that when errLocked is
+// returned the caller can tell what the holder is downloading.
+func lockOutput(name, url string, wait bool) (*os.File, string, error) {
+	path := outLockPath(name)
+	fp, err := lockFile(path, 0644, wait)
+	if errors.Is(err, errLocked) {
+		b, _ := os.ReadFile(path)
+		return nil, strings.TrimSpace(string(b)), err
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err = fp.Truncate(0); err == nil {
+		_, err = io.WriteString(fp, url+"\n")
+	}
+	if err != nil {
+		unlockFile(fp, true)
+		return nil, "", err
+	}
+	return fp, "", nil
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Checking that mirrors agree on a file.  Whatever most of the mirrors
+// have is taken to be right; a mirror with something else is stale if
+// its copy is older than that, and divergent otherwise.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type mirrorResult struct {
+	Mirror       string     `json:"mirror"`
+	URL          string     `json:"url"`
+	Status       string     `json:"status"`
+	Size         int64      `json:"size"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// key is what mirrors have to agree on.  Without the content to hash,
+// that has to be the modification time instead.
+func (r *mirrorResult) key() string {
+	if r.SHA256 == "" && r.LastModified != nil {
+		return fmt.Sprint(r.Size, r.LastModified.Unix())
+	}
+	return fmt.Sprint(r.Size, r.SHA256)
+}
+
+// checkMirror fetches the file from a mirror, or with head, asks about it.
+func checkMirror(r *mirrorResult, head bool) error {
+	method := http.MethodGet
+	if head {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequest(method, r.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{r.URL, resp.StatusCode, resp.Status}
+	}
+
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		r.LastModified = &t
+	}
+	if head {
+		if resp.ContentLength < 0 {
+			return errors.New("no Content-Length")
+		}
+		r.Size = resp.ContentLength
+		return nil
+	}
+	h := sha256.New()
+	if r.Size, err = io.Copy(h, limitReader(resp.Body, r.URL)); err != nil {
+		return err
+	}
+	r.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// judge sets the status of each result against what most mirrors have, or
+// of those versions, the newest, or of those, the one listed first.
+func judge(results []*mirrorResult) {
+	count := make(map[string]int)
+	newest := make(map[string]time.Time)
+	for _, r := range results {
+		if r.Error != "" {
+			continue
+		}
+		k := r.key()
+		count[k]++
+		if r.LastModified != nil && r.LastModified.After(newest[k]) {
+			newest[k] = *r.LastModified
+		}
+	}
+	// In the order of the results, not the map, so that ties always go
+	// the same way.
+	best := ""
+	for _, r := range results {
+		if r.Error != "" {
+			continue
+		}
+		k, n := r.key(), count[r.key()]
+		if best == "" || n > count[best] ||
+			n == count[best] && newest[k].After(newest[best]) {
+			best = k
+		}
+	}
+
+	for _, r := range results {
+		switch {
+		case r.Error != "":
+			r.Status = "error"
+		case r.key() == best:
+			r.Status = "ok"
+		case r.LastModified != nil && r.LastModified.Before(newest[best]):
+			r.Status = "stale"
+		default:
+			r.Status = "divergent"
+		}
+	}
+}
+
+func readMirrorList(name string) ([]string, error) {
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var l []string
+	sc := bufio.NewScanner(fp)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && line[0] != '#' {
+			l = append(l, line)
+		}
+	}
+	return l, sc.Err()
+}
+
+func mirrorsMain(args []string) error {
+	fs := flag.NewFlagSet("mirrors", flag.ExitOnError)
+	fflag := fs.String("f", "", "file listing mirror URLs, one per line")
+	headFlag := fs.Bool("head", false,
+		"only compare size and Last-Modified, without downloading")
+	jsonFlag := fs.Bool("json", false, "report in JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),
+			"usage: goget mirrors [options] path [mirror ...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	p := strings.TrimPrefix(fs.Arg(0), "/")
+	mirrors := fs.Args()[1:]
+	if *fflag != "" {
+		l, err := readMirrorList(*fflag)
+		if err != nil {
+			return err
+		}
+		mirrors = append(mirrors, l...)
+	}
+	if len(mirrors) == 0 {
+		return errors.New("no mirrors to check")
+	}
+
+	results := make([]*mirrorResult, len(mirrors))
+	ch := make(chan struct{}, *pflag)
+	routines := 0
+	for i, m := range mirrors {
+		if routines >= *pflag {
+			<-ch
+			routines--
+		}
+		r := &mirrorResult{
+			Mirror: m,
+			URL:    strings.TrimSuffix(m, "/") + "/" + p,
+		}
+		results[i] = r
+		go func() {
+			if err := checkMirror(r, *headFlag); err != nil {
+				r.Error = err.Error()
+			}
+			ch <- struct{}{}
+		}()
+		routines++
+	}
+	for ; routines > 0; routines-- {
+		<-ch
+	}
+	judge(results)
+
+	if *jsonFlag {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "\t")
+		if err := e.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "MIRROR\tSTATUS\tSIZE\tLAST-MODIFIED\tSHA256")
+		for _, r := range results {
+			lm, sum := "-", "-"
+			if r.LastModified != nil {
+				lm = r.LastModified.UTC().Format(time.DateTime)
+			}
+			if r.SHA256 != "" {
+				sum = r.SHA256[:16]
+			}
+			if r.Error != "" {
+				sum = r.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n",
+				r.Mirror, r.Status, r.Size, lm, sum)
+		}
+		tw.Flush()
+	}
+
+	bad := 0
+	for _, r := range results {
+		if r.Status != "ok" {
+			bad++
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d mirrors disagree or failed", bad,
+			len(results))
+	}
+	return nil
+}
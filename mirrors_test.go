@@ -0,0 +1,48 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestJudgeTie(t *testing.T) {
+	// Many versions, each on two mirrors, so that map order would
+	// show.
+	for try := 0; try < 20; try++ {
+		var results []*mirrorResult
+		for i := 0; i < 8; i++ {
+			for j := 0; j < 2; j++ {
+				results = append(results, &mirrorResult{
+					Mirror: fmt.Sprint("m", i, j),
+					Size:   100,
+					SHA256: fmt.Sprint(i),
+				})
+			}
+		}
+		results = append(results, &mirrorResult{Mirror: "down", Error: "timeout"})
+		judge(results)
+		for i, r := range results[:len(results)-1] {
+			want := "divergent"
+			if i < 2 {
+				want = "ok"
+			}
+			if r.Status != want {
+				t.Fatalf("%s: %s, expected %s", r.Mirror, r.Status, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,531 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Capturing MQTT messages.  For mqtt:// and mqtts:// URLs, the path is a
+// topic filter to subscribe to, and what is "downloaded" is the messages
+// published to it, until there are enough of them or time is up.  Both
+// MQTT 3.1.1 and MQTT 5 are spoken, as a client only.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var mqttCountFlag = flag.Int("mqtt-count", 0,
+	"stop capturing MQTT messages after this many (default: no limit)")
+var mqttTimeoutFlag = flag.Duration("mqtt-timeout", 0,
+	"stop capturing MQTT messages after this long (default: no limit)")
+var mqttFormatFlag = flag.String("mqtt-format", "raw",
+	"how to write MQTT messages: raw, one payload per line, or json, one object per line")
+var mqttVersionFlag = flag.String("mqtt-version", "3.1.1",
+	"MQTT version to speak: 3.1.1 or 5")
+var mqttQoSFlag = flag.Int("mqtt-qos", 0, "QoS to subscribe with: 0, 1 or 2")
+
+// MQTT control packet types
+const (
+	mqttCONNECT    = 1
+	mqttCONNACK    = 2
+	mqttPUBLISH    = 3
+	mqttPUBACK     = 4
+	mqttPUBREC     = 5
+	mqttPUBREL     = 6
+	mqttPUBCOMP    = 7
+	mqttSUBSCRIBE  = 8
+	mqttSUBACK     = 9
+	mqttPINGREQ    = 12
+	mqttPINGRESP   = 13
+	mqttDISCONNECT = 14
+)
+
+const mqttKeepAlive = 60 * time.Second
+
+// mqttMaxPacket is the most we take in one packet.  MQTT 5 brokers are
+// told; others may find out by being hung up on.
+const mqttMaxPacket = 16 << 20
+
+type mqttPacket struct {
+	typ   int
+	flags byte
+	body  []byte
+}
+
+type mqttMessage struct {
+	Topic   string    `json:"topic"`
+	Time    time.Time `json:"time"`
+	Retain  bool      `json:"retain,omitempty"`
+	Payload *string   `json:"payload,omitempty"`
+	Base64  []byte    `json:"payload_base64,omitempty"`
+}
+
+func isMQTT(u string) bool {
+	return strings.HasPrefix(u, "mqtt://") || strings.HasPrefix(u, "mqtts://")
+}
+
+func appendVarint(b []byte, n int) []byte {
+	for {
+		c := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readVarint reads a variable byte integer from the start of b, and
+// returns it along with how long it was.
+func readVarint(b []byte) (int, int, error) {
+	n, mul := 0, 1
+	for i := 0; i < 4 && i < len(b); i++ {
+		n += int(b[i]&0x7f) * mul
+		if b[i]&0x80 == 0 {
+			return n, i + 1, nil
+		}
+		mul *= 128
+	}
+	return 0, 0, errors.New("mqtt: bad variable length integer")
+}
+
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n, mul := 0, 1
+	for i := 0; ; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n += int(c&0x7f) * mul
+		if c&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return nil, errors.New("mqtt: bad remaining length")
+		}
+		mul *= 128
+	}
+	if n > mqttMaxPacket {
+		return nil, fmt.Errorf("mqtt: %d byte packet, more than %d", n, mqttMaxPacket)
+	}
+	p := &mqttPacket{typ: int(h >> 4), flags: h & 0xf, body: make([]byte, n)}
+	if _, err = io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type mqttConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	v5   bool
+}
+
+func (c *mqttConn) send(typ int, flags byte, body []byte) error {
+	b := []byte{byte(typ<<4) | flags}
+	b = appendVarint(b, len(body))
+	_, err := c.conn.Write(append(b, body...))
+	return err
+}
+
+// skipProps skips the MQTT 5 properties at the start of b.
+func (c *mqttConn) skipProps(b []byte) ([]byte, error) {
+	if !c.v5 {
+		return b, nil
+	}
+	n, l, err := readVarint(b)
+	if err != nil || l+n > len(b) {
+		return nil, errors.New("mqtt: bad properties")
+	}
+	return b[l+n:], nil
+}
+
+// mqttDial connects to the broker of u and logs in.
+func mqttDial(ctx context.Context, u *url.URL) (*mqttConn, error) {
+	var v5 bool
+	switch *mqttVersionFlag {
+	case "3.1.1":
+	case "5":
+		v5 = true
+	default:
+		return nil, fmt.Errorf("%q: -mqtt-version must be 3.1.1 or 5",
+			*mqttVersionFlag)
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "1883"
+		if u.Scheme == "mqtts" {
+			port = "8883"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+	var conn net.Conn
+	var err error
+	if u.Scheme == "mqtts" {
+		cfg := tlsConfig.Clone()
+		cfg.ServerName = host
+		cfg = hostKeys.config(cfg, addr)
+		if cfg, err = daneConfig(cfg, host, port); err != nil {
+			return nil, err
+		}
+		td := tlsDialer{tls: tlsConfig, dial: dial}
+		conn, err = td.handshake(ctx, "tcp", addr, cfg)
+	} else {
+		conn, err = dial(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttConn{conn: conn, r: bufio.NewReader(conn), v5: v5}
+
+	var id [6]byte
+	rand.Read(id[:])
+	level, flags := byte(4), byte(0x02) // clean session
+	if v5 {
+		level = 5
+	}
+	if u.User != nil {
+		flags |= 0x80
+		if _, ok := u.User.Password(); ok {
+			flags |= 0x40
+		}
+	}
+	b := appendMQTTString(nil, "MQTT")
+	b = append(b, level, flags)
+	b = binary.BigEndian.AppendUint16(b, uint16(mqttKeepAlive/time.Second))
+	if v5 {
+		b = appendVarint(b, 5)
+		b = append(b, 0x27) // Maximum Packet Size
+		b = binary.BigEndian.AppendUint32(b, mqttMaxPacket)
+	}
+	b = appendMQTTString(b, "goget-"+hex.EncodeToString(id[:]))
+	if u.User != nil {
+		b = appendMQTTString(b, u.User.Username())
+		if pw, ok := u.User.Password(); ok {
+			b = appendMQTTString(b, pw)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	err = c.send(mqttCONNECT, 0, b)
+	var p *mqttPacket
+	if err == nil {
+		p, err = readMQTTPacket(c.r)
+	}
+	if err == nil && (p.typ != mqttCONNACK || len(p.body) < 2) {
+		err = errors.New("mqtt: expected CONNACK")
+	}
+	if err == nil && p.body[1] != 0 {
+		err = fmt.Errorf("mqtt: %s: connection refused, reason %#x",
+			addr, p.body[1])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// subscribe subscribes to topic and waits for the broker to say yes.
+func (c *mqttConn) subscribe(topic string, qos int) error {
+	b := binary.BigEndian.AppendUint16(nil, 1)
+	if c.v5 {
+		b = appendVarint(b, 0)
+	}
+	b = appendMQTTString(b, topic)
+	b = append(b, byte(qos))
+	if err := c.send(mqttSUBSCRIBE, 0x2, b); err != nil {
+		return err
+	}
+	p, err := readMQTTPacket(c.r)
+	if err != nil {
+		return err
+	}
+	if p.typ != mqttSUBACK || len(p.body) < 2 {
+		return errors.New("mqtt: expected SUBACK")
+	}
+	rest, err := c.skipProps(p.body[2:])
+	if err != nil {
+		return err
+	}
+	if len(rest) < 1 || rest[0] >= 0x80 {
+		return fmt.Errorf("mqtt: subscription to %q refused", topic)
+	}
+	return nil
+}
+
+// mqttTopic gets the topic filter out of u.  A # can't be escaped in a
+// topic, so a fragment is taken to be part of it.
+func mqttTopic(rawurl string, u *url.URL) string {
+	topic := strings.TrimPrefix(u.Path, "/")
+	if i := strings.IndexByte(rawurl, '#'); i >= 0 {
+		topic += rawurl[i:]
+	}
+	return topic
+}
+
+// mqttFileName names the file for the messages on the topic filter in
+// rawurl: its levels joined with _, and + and # spelled out, as they are
+// no better in file names than / is.
+func mqttFileName(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "mqtt"
+	}
+	levels := strings.Split(mqttTopic(rawurl, u), "/")
+	for i, l := range levels {
+		switch l {
+		case "+":
+			levels[i] = "any"
+		case "#":
+			levels[i] = "all"
+		}
+	}
+	// What is left of them isn't valid in a filter, but still.
+	name := strings.NewReplacer("+", "_", "#", "_").Replace(
+		strings.Join(levels, "_"))
+	if strings.Trim(name, "._") == "" {
+		return "mqtt"
+	}
+	return name
+}
+
+// mqttCapture subscribes to the topic filter in rawurl and writes the
+// messages that come to the file f.
+func mqttCapture(ctx context.Context, rawurl, f string) error {
+	if !*qflag {
+		fmt.Println("SUBSCRIBE", rawurl)
+	}
+	switch *mqttFormatFlag {
+	case "raw", "json":
+	default:
+		return fmt.Errorf("%q: -mqtt-format must be raw or json",
+			*mqttFormatFlag)
+	}
+	if *mqttQoSFlag < 0 || *mqttQoSFlag > 2 {
+		return fmt.Errorf("%d: -mqtt-qos must be 0, 1 or 2", *mqttQoSFlag)
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	topic := mqttTopic(rawurl, u)
+	if topic == "" {
+		return fmt.Errorf("%s: no topic", rawurl)
+	}
+
+	fp, err := os.Create(f)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	pipe, err := startPipe(rawurl)
+	if err != nil {
+		return err
+	}
+	err = mqttReceive(ctx, u, topic, bufio.NewWriter(pipe.tee(fp)))
+	return pipe.finish(err)
+}
+
+// mqttReceive writes the messages published to topic to w.
+func mqttReceive(ctx context.Context, u *url.URL, topic string, w *bufio.Writer) error {
+	c, err := mqttDial(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	if err = c.subscribe(topic, *mqttQoSFlag); err != nil {
+		return err
+	}
+
+	// The reader stops at done, or when the connection is closed under
+	// it, whichever it is waiting for.
+	packets := make(chan *mqttPacket)
+	rerr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			p, err := readMQTTPacket(c.r)
+			if err != nil {
+				rerr <- err
+				return
+			}
+			select {
+			case packets <- p:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var end <-chan time.Time
+	if *mqttTimeoutFlag > 0 {
+		end = time.After(*mqttTimeoutFlag)
+	}
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+
+	n := 0
+	pending := make(map[uint16]bool) // QoS 2 messages not released yet
+	for *mqttCountFlag == 0 || n < *mqttCountFlag {
+		var p *mqttPacket
+		select {
+		case p = <-packets:
+		case err = <-rerr:
+			if errors.Is(err, io.EOF) {
+				err = errors.New("mqtt: broker closed the connection")
+			}
+			return err
+		case <-end:
+			return c.finish(w)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ping.C:
+			if err = c.send(mqttPINGREQ, 0, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch p.typ {
+		case mqttPUBLISH:
+			m, id, err := c.parsePublish(p)
+			if err != nil {
+				return err
+			}
+			qos := p.flags >> 1 & 3
+			switch qos {
+			case 1:
+				err = c.send(mqttPUBACK, 0, binary.BigEndian.AppendUint16(nil, id))
+			case 2:
+				err = c.send(mqttPUBREC, 0, binary.BigEndian.AppendUint16(nil, id))
+				if pending[id] {
+					continue // a resend of what we have
+				}
+				pending[id] = true
+			}
+			if err != nil {
+				return err
+			}
+			if err = writeMQTTMessage(w, m); err != nil {
+				return err
+			}
+			n++
+		case mqttPUBREL:
+			if len(p.body) < 2 {
+				return errors.New("mqtt: bad PUBREL")
+			}
+			delete(pending, binary.BigEndian.Uint16(p.body))
+			if err = c.send(mqttPUBCOMP, 0, p.body[:2]); err != nil {
+				return err
+			}
+		case mqttPINGRESP:
+		case mqttDISCONNECT:
+			reason := byte(0)
+			if len(p.body) > 0 {
+				reason = p.body[0]
+			}
+			return fmt.Errorf("mqtt: broker disconnected, reason %#x", reason)
+		default:
+			return fmt.Errorf("mqtt: unexpected packet type %d", p.typ)
+		}
+	}
+	return c.finish(w)
+}
+
+func (c *mqttConn) parsePublish(p *mqttPacket) (*mqttMessage, uint16, error) {
+	b := p.body
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return nil, 0, errors.New("mqtt: bad PUBLISH")
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	m := &mqttMessage{
+		Topic:  string(b[2 : 2+l]),
+		Time:   time.Now(),
+		Retain: p.flags&1 != 0,
+	}
+	b = b[2+l:]
+	var id uint16
+	if p.flags>>1&3 > 0 {
+		if len(b) < 2 {
+			return nil, 0, errors.New("mqtt: bad PUBLISH")
+		}
+		id = binary.BigEndian.Uint16(b)
+		b = b[2:]
+	}
+	b, err := c.skipProps(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if utf8.Valid(b) {
+		s := string(b)
+		m.Payload = &s
+	} else {
+		m.Base64 = b
+	}
+	return m, id, nil
+}
+
+func writeMQTTMessage(w *bufio.Writer, m *mqttMessage) error {
+	if *mqttFormatFlag == "json" {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		w.Write(b)
+	} else if m.Payload != nil {
+		w.WriteString(*m.Payload)
+	} else {
+		w.Write(m.Base64)
+	}
+	if err := w.WriteByte('\n'); err != nil {
+		return err
+	}
+	// Whoever reads the file or the -pipe command as it is written
+	// gets each message as soon as it comes.
+	return w.Flush()
+}
+
+// finish says goodbye to the broker, and writes out what is left.
+func (c *mqttConn) finish(w *bufio.Writer) error {
+	c.send(mqttDISCONNECT, 0, nil)
+	return w.Flush()
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/url"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMQTTBroker accepts one client on a local socket, lets it log in and
+// subscribe, and then publishes each of msgs to it at QoS 0.  It returns
+// the broker's address and a channel closed once the client hangs up.
+func testMQTTBroker(t *testing.T, v5 bool, msgs ...string) (string, <-chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := &mqttConn{conn: conn, r: bufio.NewReader(conn), v5: v5}
+		if p, err := readMQTTPacket(c.r); err != nil || p.typ != mqttCONNECT {
+			return
+		}
+		connack := []byte{0, 0}
+		if v5 {
+			connack = appendVarint(connack, 0)
+		}
+		c.send(mqttCONNACK, 0, connack)
+		p, err := readMQTTPacket(c.r)
+		if err != nil || p.typ != mqttSUBSCRIBE || len(p.body) < 2 {
+			return
+		}
+		suback := p.body[:2]
+		if v5 {
+			suback = appendVarint(suback, 0)
+		}
+		c.send(mqttSUBACK, 0, append(suback, 0))
+
+		for _, m := range msgs {
+			b := appendMQTTString(nil, "rig1/temp")
+			if v5 {
+				b = appendVarint(b, 0)
+			}
+			c.send(mqttPUBLISH, 0, append(b, m...))
+		}
+		// Wait for the client to go away.
+		for {
+			if _, err := readMQTTPacket(c.r); err != nil {
+				return
+			}
+		}
+	}()
+	return ln.Addr().String(), gone
+}
+
+func TestMQTTReceive(t *testing.T) {
+	*qflag = true
+	for _, v := range []string{"3.1.1", "5"} {
+		t.Run(v, func(t *testing.T) {
+			defer func(v, f string, n int) {
+				*mqttVersionFlag, *mqttFormatFlag, *mqttCountFlag = v, f, n
+			}(*mqttVersionFlag, *mqttFormatFlag, *mqttCountFlag)
+			*mqttVersionFlag, *mqttFormatFlag, *mqttCountFlag = v, "raw", 2
+
+			// More messages than are wanted, so that some come after.
+			addr, gone := testMQTTBroker(t, v == "5", "1", "2", "3", "4")
+			u := &url.URL{Scheme: "mqtt", Host: addr, Path: "/rig1/#"}
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			if err := mqttReceive(context.Background(), u, "rig1/#", w); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != "1\n2\n" {
+				t.Errorf("got %q", got)
+			}
+			select {
+			case <-gone:
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection left open")
+			}
+		})
+	}
+	testNoMQTTReader(t)
+}
+
+// testNoMQTTReader fails if mqttReceive left a packet reader running.
+func testNoMQTTReader(t *testing.T) {
+	buf := make([]byte, 1<<20)
+	for i := 0; i < 100; i++ {
+		n := runtime.Stack(buf, true)
+		if !strings.Contains(string(buf[:n]), "mqttReceive.func") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("packet reader still running")
+}
+
+func TestMQTTFileName(t *testing.T) {
+	for u, want := range map[string]string{
+		"mqtt://broker.lab/rig1/#":        "rig1_all",
+		"mqtts://broker.lab/+/temp":       "any_temp",
+		"mqtt://broker.lab/rig1/temp":     "rig1_temp",
+		"mqtt://broker.lab/#":             "all",
+		"mqtt://broker.lab/..":            "mqtt",
+		"mqtt://broker.lab/a%2Fb/c?x=1#y": "a_b_c_y",
+	} {
+		if got := mqttFileName(u); got != want {
+			t.Errorf("%s: got %q, expected %q", u, got, want)
+		}
+	}
+}
+
+func TestMQTTMaxPacket(t *testing.T) {
+	// PUBLISH, remaining length 200MB, and no more.
+	b := appendVarint([]byte{mqttPUBLISH << 4}, 200<<20)
+	if _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(b))); err == nil {
+		t.Error("200MB packet accepted")
+	}
+}
@@ -0,0 +1,520 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Just enough OpenPGP (RFC 4880, plus EdDSA) to check signatures made by
+// keys from a keyring we trust as a whole, the way gpgv(1) does.  Only v4
+// keys and signatures are understood.  Every key in the keyring, subkeys
+// included, is taken as valid: neither binding signatures, expiry nor
+// revocations are looked at.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var errPGPFormat = errors.New("openpgp: malformed data")
+
+const (
+	pgpTagSignature = 2
+	pgpTagPublicKey = 6
+	pgpTagSubkey    = 14
+)
+
+var (
+	oidEd25519 = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+	oidCurves  = map[string]elliptic.Curve{
+		"\x2a\x86\x48\xce\x3d\x03\x01\x07": elliptic.P256(),
+		"\x2b\x81\x04\x00\x22":             elliptic.P384(),
+		"\x2b\x81\x04\x00\x23":             elliptic.P521(),
+	}
+	pgpHashes = map[byte]crypto.Hash{
+		8:  crypto.SHA256,
+		9:  crypto.SHA384,
+		10: crypto.SHA512,
+		11: crypto.SHA224,
+	}
+)
+
+type pgpPacket struct {
+	tag  int
+	body []byte
+}
+
+type pgpKey struct {
+	id  uint64
+	fpr []byte
+	pub crypto.PublicKey
+}
+
+type pgpSig struct {
+	typ    byte
+	algo   byte
+	hash   crypto.Hash
+	hashed []byte // from the version up to the end of hashed subpackets
+	issuer uint64
+	fpr    []byte
+	left16 []byte
+	sig    [][]byte // MPIs, or a raw signature
+}
+
+// newLength reads a new-format packet length.  Partial lengths are
+// reported with partial set.
+func newLength(b []byte) (n, hlen int, partial bool, err error) {
+	if len(b) < 1 {
+		return 0, 0, false, errPGPFormat
+	}
+	switch o := int(b[0]); {
+	case o < 192:
+		return o, 1, false, nil
+	case o < 224:
+		if len(b) < 2 {
+			return 0, 0, false, errPGPFormat
+		}
+		return (o-192)<<8 + int(b[1]) + 192, 2, false, nil
+	case o < 255:
+		return 1 << uint(o&0x1f), 1, true, nil
+	default:
+		if len(b) < 5 {
+			return 0, 0, false, errPGPFormat
+		}
+		return int(binary.BigEndian.Uint32(b[1:5])), 5, false, nil
+	}
+}
+
+func readPackets(b []byte) ([]pgpPacket, error) {
+	var pkts []pgpPacket
+	for len(b) > 0 {
+		h := b[0]
+		b = b[1:]
+		if h&0x80 == 0 {
+			return nil, errPGPFormat
+		}
+
+		var p pgpPacket
+		if h&0x40 != 0 {
+			p.tag = int(h & 0x3f)
+			for {
+				n, hlen, partial, err := newLength(b)
+				if err != nil || hlen+n > len(b) {
+					return nil, errPGPFormat
+				}
+				p.body = append(p.body, b[hlen:hlen+n]...)
+				b = b[hlen+n:]
+				if !partial {
+					break
+				}
+			}
+		} else {
+			p.tag = int(h>>2) & 0xf
+			var n int
+			switch h & 3 {
+			case 0:
+				if len(b) < 1 {
+					return nil, errPGPFormat
+				}
+				n, b = int(b[0]), b[1:]
+			case 1:
+				if len(b) < 2 {
+					return nil, errPGPFormat
+				}
+				n, b = int(binary.BigEndian.Uint16(b)), b[2:]
+			case 2:
+				if len(b) < 4 {
+					return nil, errPGPFormat
+				}
+				n, b = int(binary.BigEndian.Uint32(b)), b[4:]
+			case 3:
+				n = len(b)
+			}
+			if n < 0 || n > len(b) {
+				return nil, errPGPFormat
+			}
+			p.body, b = b[:n], b[n:]
+		}
+		pkts = append(pkts, p)
+	}
+	return pkts, nil
+}
+
+// readMPI reads a multiprecision integer, returning its bytes and the rest.
+func readMPI(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errPGPFormat
+	}
+	n := (int(binary.BigEndian.Uint16(b)) + 7) / 8
+	if len(b) < 2+n {
+		return nil, nil, errPGPFormat
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+// dearmor decodes every ASCII-armored block in b, or returns b as is if it
+// isn't armored at all.
+func dearmor(b []byte) ([]byte, error) {
+	s := string(b)
+	if !strings.Contains(s, "-----BEGIN PGP ") {
+		return b, nil
+	}
+
+	var out []byte
+	for {
+		i := strings.Index(s, "-----BEGIN PGP ")
+		if i < 0 {
+			break
+		}
+		s = s[i:]
+		_, s, _ = strings.Cut(s, "\n")
+		// Armor headers run up to the first blank line.
+		for {
+			var line string
+			line, s, _ = strings.Cut(s, "\n")
+			if strings.TrimSpace(line) == "" {
+				break
+			}
+		}
+
+		var enc strings.Builder
+		for {
+			var line string
+			var ok bool
+			line, s, ok = strings.Cut(s, "\n")
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "-----END PGP ") {
+				break
+			}
+			if !ok {
+				return nil, errPGPFormat
+			}
+			if strings.HasPrefix(line, "=") {
+				continue // checksum
+			}
+			enc.WriteString(line)
+		}
+		d, err := base64.StdEncoding.DecodeString(enc.String())
+		if err != nil {
+			return nil, fmt.Errorf("openpgp: %w", err)
+		}
+		out = append(out, d...)
+	}
+	return out, nil
+}
+
+func parsePGPKey(body []byte) (*pgpKey, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, errors.New("openpgp: unsupported key version")
+	}
+	algo, r := body[5], body[6:]
+
+	k := new(pgpKey)
+	switch algo {
+	case 1, 2, 3: // RSA
+		n, r, err := readMPI(r)
+		if err != nil {
+			return nil, err
+		}
+		e, _, err := readMPI(r)
+		if err != nil || len(e) > 4 {
+			return nil, errPGPFormat
+		}
+		k.pub = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	case 19, 22: // ECDSA, EdDSA
+		if len(r) < 1 || len(r) < 1+int(r[0]) {
+			return nil, errPGPFormat
+		}
+		oid := r[1 : 1+r[0]]
+		p, _, err := readMPI(r[1+r[0]:])
+		if err != nil {
+			return nil, err
+		}
+		if algo == 22 {
+			if !bytes.Equal(oid, oidEd25519) || len(p) != 33 ||
+				p[0] != 0x40 {
+				return nil, errors.New("openpgp: unsupported EdDSA curve")
+			}
+			k.pub = ed25519.PublicKey(p[1:])
+			break
+		}
+		curve, ok := oidCurves[string(oid)]
+		if !ok {
+			return nil, errors.New("openpgp: unsupported ECDSA curve")
+		}
+		x, y := elliptic.Unmarshal(curve, p)
+		if x == nil {
+			return nil, errPGPFormat
+		}
+		k.pub = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	case 27: // Ed25519
+		if len(r) != ed25519.PublicKeySize {
+			return nil, errPGPFormat
+		}
+		k.pub = ed25519.PublicKey(r)
+	default:
+		return nil, fmt.Errorf("openpgp: unsupported key algorithm %d", algo)
+	}
+
+	h := sha1.New()
+	h.Write([]byte{0x99, byte(len(body) >> 8), byte(len(body))})
+	h.Write(body)
+	k.fpr = h.Sum(nil)
+	k.id = binary.BigEndian.Uint64(k.fpr[12:])
+	return k, nil
+}
+
+// readKeyring reads the keys we can use out of a binary or armored
+// keyring.
+func readKeyring(b []byte) ([]pgpKey, error) {
+	b, err := dearmor(b)
+	if err != nil {
+		return nil, err
+	}
+	pkts, err := readPackets(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []pgpKey
+	for _, p := range pkts {
+		if p.tag != pgpTagPublicKey && p.tag != pgpTagSubkey {
+			continue
+		}
+		if k, err := parsePGPKey(p.body); err == nil {
+			keys = append(keys, *k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("openpgp: no usable keys in keyring")
+	}
+	return keys, nil
+}
+
+func parsePGPSig(body []byte) (*pgpSig, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, errors.New("openpgp: unsupported signature version")
+	}
+	s := &pgpSig{typ: body[1], algo: body[2]}
+	// Only signatures of binary documents and canonical text say
+	// anything about the data; the rest are about keys.
+	if s.typ != 0x00 && s.typ != 0x01 {
+		return nil, fmt.Errorf("openpgp: signature type %#02x is not over a document",
+			s.typ)
+	}
+	var ok bool
+	if s.hash, ok = pgpHashes[body[3]]; !ok {
+		return nil, fmt.Errorf("openpgp: unsupported hash algorithm %d",
+			body[3])
+	}
+
+	end := 6 + int(binary.BigEndian.Uint16(body[4:]))
+	if len(body) < end+2 {
+		return nil, errPGPFormat
+	}
+	s.hashed = body[:end]
+	hashedSub := body[6:end]
+	uend := end + 2 + int(binary.BigEndian.Uint16(body[end:]))
+	if len(body) < uend+2 {
+		return nil, errPGPFormat
+	}
+	unhashedSub := body[end+2 : uend]
+	s.left16 = body[uend : uend+2]
+	r := body[uend+2:]
+
+	for _, sub := range [][]byte{hashedSub, unhashedSub} {
+		for len(sub) > 0 {
+			n, hlen, partial, err := newLength(sub)
+			if err != nil || partial || n < 1 || hlen+n > len(sub) {
+				return nil, errPGPFormat
+			}
+			d := sub[hlen : hlen+n]
+			switch d[0] & 0x7f {
+			case 16:
+				if len(d) == 9 {
+					s.issuer = binary.BigEndian.Uint64(d[1:])
+				}
+			case 33:
+				if len(d) > 2 {
+					s.fpr = d[2:]
+				}
+			}
+			sub = sub[hlen+n:]
+		}
+	}
+
+	if s.algo == 27 {
+		if len(r) != ed25519.SignatureSize {
+			return nil, errPGPFormat
+		}
+		s.sig = [][]byte{r}
+		return s, nil
+	}
+	for len(r) > 0 {
+		m, rest, err := readMPI(r)
+		if err != nil {
+			return nil, err
+		}
+		s.sig = append(s.sig, m)
+		r = rest
+	}
+	return s, nil
+}
+
+func (s *pgpSig) issuedBy(k *pgpKey) bool {
+	switch {
+	case s.fpr != nil:
+		return bytes.Equal(s.fpr, k.fpr)
+	case s.issuer != 0:
+		return s.issuer == k.id
+	}
+	return true
+}
+
+func (s *pgpSig) verify(keys []pgpKey, data []byte) error {
+	h := s.hash.New()
+	h.Write(data)
+	h.Write(s.hashed)
+	var trailer [6]byte
+	trailer[0], trailer[1] = 4, 0xff
+	binary.BigEndian.PutUint32(trailer[2:], uint32(len(s.hashed)))
+	h.Write(trailer[:])
+	digest := h.Sum(nil)
+	if !bytes.Equal(digest[:2], s.left16) {
+		return errors.New("openpgp: bad signature")
+	}
+
+	for i := range keys {
+		k := &keys[i]
+		if !s.issuedBy(k) {
+			continue
+		}
+		ok := false
+		switch pub := k.pub.(type) {
+		case *rsa.PublicKey:
+			// MPIs lose their leading zeros, which Go wants back.
+			if len(s.sig) == 1 && len(s.sig[0]) <= pub.Size() {
+				sig := make([]byte, pub.Size())
+				copy(sig[pub.Size()-len(s.sig[0]):], s.sig[0])
+				ok = rsa.VerifyPKCS1v15(pub, s.hash, digest, sig) == nil
+			}
+		case ed25519.PublicKey:
+			if s.algo == 27 {
+				ok = ed25519.Verify(pub, digest, s.sig[0])
+			} else if len(s.sig) == 2 && len(s.sig[0]) <= 32 &&
+				len(s.sig[1]) <= 32 {
+				var sig [64]byte
+				copy(sig[32-len(s.sig[0]):32], s.sig[0])
+				copy(sig[64-len(s.sig[1]):], s.sig[1])
+				ok = ed25519.Verify(pub, digest, sig[:])
+			}
+		case *ecdsa.PublicKey:
+			ok = len(s.sig) == 2 && ecdsa.Verify(pub, digest,
+				new(big.Int).SetBytes(s.sig[0]),
+				new(big.Int).SetBytes(s.sig[1]))
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("openpgp: no valid signature by a known key (issuer %016X)",
+		s.issuer)
+}
+
+// canonicalText turns line endings into CRLF, as text signatures want.
+func canonicalText(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
+
+// pgpVerifyDetached checks that data carries a good detached signature,
+// binary or armored, by one of keys.
+func pgpVerifyDetached(keys []pgpKey, data, sig []byte) error {
+	sig, err := dearmor(sig)
+	if err != nil {
+		return err
+	}
+	pkts, err := readPackets(sig)
+	if err != nil {
+		return err
+	}
+
+	err = errors.New("openpgp: no signature")
+	for _, p := range pkts {
+		if p.tag != pgpTagSignature {
+			continue
+		}
+		s, perr := parsePGPSig(p.body)
+		if perr != nil {
+			err = perr
+			continue
+		}
+		d := data
+		if s.typ == 0x01 {
+			d = canonicalText(data)
+		}
+		if err = s.verify(keys, d); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// pgpVerifyClearsigned checks a cleartext signed message, and returns the
+// text that was signed.
+func pgpVerifyClearsigned(keys []pgpKey, msg []byte) ([]byte, error) {
+	lines := strings.Split(strings.ReplaceAll(string(msg), "\r\n", "\n"), "\n")
+	if len(lines) == 0 || lines[0] != "-----BEGIN PGP SIGNED MESSAGE-----" {
+		return nil, errors.New("openpgp: not a cleartext signed message")
+	}
+	i := 1
+	for i < len(lines) && lines[i] != "" {
+		i++
+	}
+	i++
+
+	var text, signed []string
+	for ; i < len(lines); i++ {
+		if lines[i] == "-----BEGIN PGP SIGNATURE-----" {
+			break
+		}
+		line := strings.TrimPrefix(lines[i], "- ")
+		text = append(text, line)
+		signed = append(signed, strings.TrimRight(line, " \t"))
+	}
+	if i == len(lines) {
+		return nil, errors.New("openpgp: no signature in cleartext message")
+	}
+
+	sig := []byte(strings.Join(lines[i:], "\n"))
+	data := []byte(strings.Join(signed, "\r\n"))
+	if err := pgpVerifyDetached(keys, data, sig); err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(text, "\n") + "\n"), nil
+}
@@ -0,0 +1,424 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Sharing downloads with other gogets on the LAN.  Each keeps what it
+// downloaded in a cache named by content hash, serves it over HTTP, and
+// advertises that with mDNS/DNS-SD.  Before going to the origin, goget
+// asks the peers it finds for the file, but only when there is a
+// published checksum to check what they send against.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var peersFlag = flag.Bool("peers", false,
+	"get files from other gogets on the LAN first, and share the ones downloaded")
+var peerCacheFlag = flag.String("peer-cache", "",
+	"directory of files shared with peers (default: goget/peers in the user cache directory)")
+
+const (
+	peerService = "_goget-cache._tcp.local."
+	peerWait    = 500 * time.Millisecond
+	peerTTL     = 120
+)
+
+// peerClient is for talking to peers, which should answer quickly and
+// have no need for proxies.
+var peerClient = &http.Client{Transport: &http.Transport{
+	DialContext:           (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+	ResponseHeaderTimeout: 10 * time.Second,
+	IdleConnTimeout:       30 * time.Second,
+}}
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// peerKinds are the checksums peers are asked by.  MD5 is not among them,
+// as it wouldn't keep a peer from sending something else.
+var peerKinds = []string{"SHA512", "SHA256"}
+
+func peerCacheDir() (string, error) {
+	if *peerCacheFlag != "" {
+		return *peerCacheFlag, nil
+	}
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d, "goget", "peers"), nil
+}
+
+// peerCacheAdd puts the file name in the cache, under each of its sums.
+// It is hard-linked when possible, and copied otherwise.
+func peerCacheAdd(name string) error {
+	dir, err := peerCacheDir()
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, k := range checksumKinds {
+		if !contains(peerKinds, k.name) {
+			continue
+		}
+		fp, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		h := k.new()
+		_, err = io.Copy(h, fp)
+		fp.Close()
+		if err != nil {
+			return err
+		}
+		d := filepath.Join(dir, strings.ToLower(k.name))
+		if err = os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+		paths = append(paths, filepath.Join(d, hex.EncodeToString(h.Sum(nil))))
+	}
+
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		if os.Link(name, p) == nil {
+			continue
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err = writeFileAtomic(p, b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peerHandler serves /file?url=U&sha256=HEX, or sha512=HEX, from the
+// cache.  The URL is only there to say what it was wanted for.
+func peerHandler(dir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		for _, k := range checksumKinds {
+			kind := strings.ToLower(k.name)
+			sum := q.Get(kind)
+			if sum == "" || !contains(peerKinds, k.name) {
+				continue
+			}
+			if b, err := hex.DecodeString(sum); err != nil || len(b) != k.size {
+				http.Error(w, "bad "+kind, http.StatusBadRequest)
+				return
+			}
+			p := filepath.Join(dir, kind, strings.ToLower(sum))
+			if _, err := os.Stat(p); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			if !*qflag {
+				fmt.Println("serving", q.Get("url"), "to", r.RemoteAddr)
+			}
+			http.ServeFile(w, r, p)
+			return
+		}
+		http.Error(w, "no sha256 or sha512", http.StatusBadRequest)
+	})
+	return mux
+}
+
+// servePeers serves the cache on addr and advertises it with mDNS.  It
+// returns once the server is listening.
+func servePeers(addr string) error {
+	dir, err := peerCacheDir()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(ln, peerHandler(dir)); err != nil {
+			fmt.Fprintln(os.Stderr, "peers:", err)
+		}
+	}()
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	host, _, _ = strings.Cut(host, ".")
+	port := ln.Addr().(*net.TCPAddr).Port
+	go mdnsRespond(conn, host, port)
+	return nil
+}
+
+// mdnsRespond answers the questions for peerService that come to conn.
+// Queries from ports other than 5353 are one-shot ones, which get their
+// answer sent straight back.
+func mdnsRespond(conn *net.UDPConn, host string, port int) {
+	instance := host + "-" + strconv.Itoa(port) + "." + peerService
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "mdns:", err)
+			return
+		}
+		r, err := dnsParse(buf[:n])
+		if err != nil || r.flags&0x8000 != 0 {
+			continue
+		}
+		asked := false
+		for _, q := range r.qs {
+			if strings.EqualFold(q.name, peerService) &&
+				(q.typ == dnsTypePTR || q.typ == 255) {
+				asked = true
+			}
+		}
+		if !asked {
+			continue
+		}
+
+		unicast := from.Port != mdnsGroup.Port
+		msg, err := mdnsAnswer(r, instance, host+".local.", port, unicast)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "mdns:", err)
+			return
+		}
+		to := mdnsGroup
+		if unicast {
+			to = from
+		}
+		conn.WriteToUDP(msg, to)
+	}
+}
+
+// mdnsAnswer builds the answer to q: a PTR to instance, and its SRV.
+func mdnsAnswer(q *dnsReply, instance, target string, port int, unicast bool) ([]byte, error) {
+	var id, qdcount uint16
+	var qd []byte
+	if unicast {
+		// The question is repeated for the benefit of ordinary
+		// resolvers.
+		id, qdcount = q.id, 1
+		var err error
+		if qd, err = packName(nil, peerService); err != nil {
+			return nil, err
+		}
+		qd = binary.BigEndian.AppendUint16(qd, dnsTypePTR)
+		qd = binary.BigEndian.AppendUint16(qd, dnsClassIN)
+	}
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, 0x8400) // response, authoritative
+	b = binary.BigEndian.AppendUint16(b, qdcount)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = append(b, qd...)
+
+	ptr, err := packName(nil, instance)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = appendRR(b, peerService, dnsTypePTR, peerTTL, ptr); err != nil {
+		return nil, err
+	}
+	srv := binary.BigEndian.AppendUint16(nil, 0) // priority
+	srv = binary.BigEndian.AppendUint16(srv, 0)  // weight
+	srv = binary.BigEndian.AppendUint16(srv, uint16(port))
+	if srv, err = packName(srv, target); err != nil {
+		return nil, err
+	}
+	return appendRR(b, instance, dnsTypeSRV, peerTTL, srv)
+}
+
+var peerOnce sync.Once
+var peerAddrs []string
+
+// findPeers asks the LAN for peers, once, and gives the addresses of the
+// ones that answered in time.  The address is the one the answer came
+// from, with the port in its SRV record.
+func findPeers() []string {
+	peerOnce.Do(func() {
+		var err error
+		if peerAddrs, err = mdnsBrowse(); err != nil {
+			fmt.Fprintln(os.Stderr, "mdns:", err)
+		}
+	})
+	return peerAddrs
+}
+
+func mdnsBrowse() ([]string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	q, err := dnsBuildQuery(0, peerService, dnsTypePTR, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.WriteToUDP(q, mdnsGroup); err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	conn.SetReadDeadline(time.Now().Add(peerWait))
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		r, err := dnsParse(buf[:n])
+		if err != nil || r.flags&0x8000 == 0 {
+			continue
+		}
+		for _, rr := range append(r.answers, r.extra...) {
+			if rr.typ != dnsTypeSRV || len(rr.data) < 6 ||
+				!strings.HasSuffix(strings.ToLower(rr.name), peerService) {
+				continue
+			}
+			port := int(binary.BigEndian.Uint16(rr.data[4:]))
+			a := net.JoinHostPort(from.IP.String(), strconv.Itoa(port))
+			if !contains(addrs, a) {
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// peerFetch tries to get u into f from a peer, by its published
+// checksum sum.  It returns the URL it got it from, or "" if none of the
+// peers had it and f is left for the origin to fill.
+func peerFetch(u, f string, sum *checksum) string {
+	// A -pipe command is fed as the file comes in, and what a peer
+	// sends is only known to be good once it is all there.
+	if !*peersFlag || sum == nil || !contains(peerKinds, sum.kind.name) ||
+		*pipeFlag != "" {
+		return ""
+	}
+	q := "url=" + url.QueryEscape(u) + "&" + strings.ToLower(sum.kind.name) +
+		"=" + hex.EncodeToString(sum.sum)
+	peers := findPeers()
+	if len(peers) == 0 {
+		return ""
+	}
+	// Peers are only trusted to send as much as the origin has.
+	size := originSize(u)
+	if size < 0 {
+		return ""
+	}
+	for _, a := range peers {
+		pu := "http://" + a + "/file?" + q
+		err := peerGet(pu, f, size)
+		if err == nil {
+			err = sum.check(f)
+		}
+		if err == nil {
+			if !*qflag {
+				fmt.Println("GET", u, "from peer", a)
+			}
+			return pu
+		}
+		var serr *statusError
+		if !errors.As(err, &serr) || serr.code != http.StatusNotFound {
+			fmt.Fprintln(os.Stderr, "peer", a+":", err)
+		}
+	}
+	return ""
+}
+
+// originSize asks the origin how big u is, or returns -1 if it won't say.
+func originSize(u string) int64 {
+	resp, err := client.Head(u)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return -1
+	}
+	return resp.ContentLength
+}
+
+// peerGet fetches u, of the given size, into f.  Not through client:
+// peers speak plain HTTP on the LAN, and want none of the origin's
+// credentials.
+func peerGet(u, f string, size int64) error {
+	resp, err := peerClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{u, resp.StatusCode, resp.Status}
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != size {
+		return fmt.Errorf("%s: %d bytes, expected %d", u, resp.ContentLength, size)
+	}
+	fp, err := os.Create(f)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(fp, io.LimitReader(resp.Body, size+1))
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("%s: %d bytes, expected %d", u, n, size)
+	}
+	return err
+}
+
+func peersMain(args []string) error {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	listen := fs.String("listen", ":0", "address to serve the cache on")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goget peers [options]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := servePeers(*listen); err != nil {
+		return err
+	}
+	select {}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Feeding downloads to a command as they come in.  The command reads from
+// a pipe, so when it falls behind, writes to the pipe block and the
+// download slows down to match, rather than piling up in memory.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var pipeFlag = flag.String("pipe", "",
+	"also stream each download into this shell command, which has to succeed for the download to")
+
+type pipeCmd struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  bool // the command stopped reading
+}
+
+// startPipe starts the -pipe command for a download of url, or returns
+// nil if there is none.  The command gets the URL in $GOGET_URL.
+func startPipe(url string) (*pipeCmd, error) {
+	if *pipeFlag == "" {
+		return nil, nil
+	}
+	cmd := exec.Command("/bin/sh", "-c", *pipeFlag)
+	cmd.Env = append(os.Environ(), "GOGET_URL="+url)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("-pipe: %w", err)
+	}
+	return &pipeCmd{cmd: cmd, stdin: w}, nil
+}
+
+// Write feeds b to the command.  A command may well stop reading before
+// the end, as head(1) does, and it is its exit status that says whether
+// that was all right, so the rest is just not fed to it.
+func (p *pipeCmd) Write(b []byte) (int, error) {
+	if p.done {
+		return len(b), nil
+	}
+	n, err := p.stdin.Write(b)
+	if errors.Is(err, syscall.EPIPE) {
+		p.done = true
+		return len(b), nil
+	}
+	if err != nil {
+		err = fmt.Errorf("-pipe: %w", err)
+	}
+	return n, err
+}
+
+// tee makes a writer to w and, if there is one, p.
+func (p *pipeCmd) tee(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return io.MultiWriter(w, p)
+}
+
+// finish ends the input of p and waits for it.  If the download failed
+// with err, the command is killed rather than left to take what it got
+// for the whole thing.
+func (p *pipeCmd) finish(err error) error {
+	if p == nil {
+		return err
+	}
+	p.stdin.Close()
+	if err != nil {
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+		return err
+	}
+	if err = p.cmd.Wait(); err != nil {
+		return fmt.Errorf("-pipe: %q: %w", *pipeFlag, err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Provenance of downloads, as an in-toto statement with a SLSA v1
+// predicate.  The files downloaded are the subjects, and the URLs they
+// came from, before and after redirects, the resolved dependencies.  With
+// a key, the statement is signed and wrapped in a DSSE envelope.
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var provenanceFlag = flag.String("provenance", "",
+	"write an in-toto provenance statement for the downloads to this file")
+var provenanceKeyFlag = flag.String("provenance-key", "",
+	"sign the provenance statement with the ed25519 private key in this PEM file")
+
+const (
+	intotoStatementType = "https://in-toto.io/Statement/v1"
+	intotoPayloadType   = "application/vnd.in-toto+json"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v1"
+	gogetBuildType      = "https://git.manpager.org/goget/download/v1"
+	gogetBuilderID      = "https://git.manpager.org/goget"
+)
+
+// prov collects the downloads, if provenance was asked for.
+var prov *provenance
+
+type provenance struct {
+	start time.Time
+	key   ed25519.PrivateKey
+
+	mu        sync.Mutex
+	urls      []string
+	subjects  []resourceDescriptor
+	materials []resourceDescriptor
+}
+
+type resourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+func newProvenance(keyfile string) (*provenance, error) {
+	p := &provenance{start: time.Now()}
+	if keyfile == "" {
+		return p, nil
+	}
+	b, err := os.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(b)
+	if blk == nil || blk.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key", keyfile)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyfile, err)
+	}
+	var ok bool
+	if p.key, ok = k.(ed25519.PrivateKey); !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", keyfile)
+	}
+	return p, nil
+}
+
+// add records the download of url, by way of final, into name, which
+// has the SHA-256 sum.  Failed downloads are asked for, but produce
+// nothing, and neither do ones another goget made.  What the URLs serve
+// is only vouched for by a published checksum that was checked.
+func (p *provenance) add(url, final, name string, sum []byte, checked *checksum, err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.urls = append(p.urls, url)
+	if err != nil || sum == nil {
+		return
+	}
+	p.subjects = append(p.subjects, resourceDescriptor{
+		Name:   name,
+		Digest: map[string]string{"sha256": hex.EncodeToString(sum)},
+	})
+	var d map[string]string
+	if checked != nil {
+		d = map[string]string{
+			strings.ToLower(checked.kind.name): hex.EncodeToString(checked.sum),
+		}
+	}
+	p.materials = append(p.materials, resourceDescriptor{URI: url, Digest: d})
+	if final != "" && final != url {
+		p.materials = append(p.materials,
+			resourceDescriptor{URI: final, Digest: d})
+	}
+}
+
+func (p *provenance) write(name string) error {
+	if len(p.subjects) == 0 {
+		return errors.New("provenance: nothing was downloaded")
+	}
+	stmt := map[string]any{
+		"_type":         intotoStatementType,
+		"subject":       p.subjects,
+		"predicateType": slsaProvenanceType,
+		"predicate": map[string]any{
+			"buildDefinition": map[string]any{
+				"buildType": gogetBuildType,
+				"externalParameters": map[string]any{
+					"urls": p.urls,
+				},
+				"resolvedDependencies": p.materials,
+			},
+			"runDetails": map[string]any{
+				"builder": map[string]any{"id": gogetBuilderID},
+				"metadata": map[string]any{
+					"startedOn":  p.start.UTC().Format(time.RFC3339),
+					"finishedOn": time.Now().UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(stmt)
+	if err != nil {
+		return err
+	}
+	if p.key != nil {
+		spki, err := x509.MarshalPKIXPublicKey(p.key.Public())
+		if err != nil {
+			return err
+		}
+		keyid := sha256.Sum256(spki)
+		sig := ed25519.Sign(p.key, dssePAE(intotoPayloadType, b))
+		env := map[string]any{
+			"payloadType": intotoPayloadType,
+			"payload":     base64.StdEncoding.EncodeToString(b),
+			"signatures": []map[string]string{{
+				"keyid": hex.EncodeToString(keyid[:]),
+				"sig":   base64.StdEncoding.EncodeToString(sig),
+			}},
+		}
+		if b, err = json.Marshal(env); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(name, append(b, '\n'), 0644)
+}
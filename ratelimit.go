@@ -0,0 +1,219 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// A global download rate limit, shared between downloads in proportion to
+// their weights.  Downloads read first and pay for it afterwards; one that
+// is in debt waits while the limiter hands out bytes every tick to whoever
+// is waiting, weight by weight.  Downloads held up by the network rather
+// than the limiter don't wait, and so don't take a share from the rest.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rflag = flag.String("r", "",
+	"limit total download rate to this many bytes per second (k, M, G suffixes)")
+var wflag = flag.String("w", "",
+	"comma-separated host=weight or URL-prefix=weight download weights")
+
+const (
+	limitTick  = 10 * time.Millisecond
+	limitChunk = 16 << 10
+)
+
+// limit is the global limiter, if there's a rate limit at all.
+var limit *limiter
+
+type limiter struct {
+	rate    float64 // bytes per second
+	weights []weightRule
+
+	mu      sync.Mutex
+	waiting map[*limitedReader]bool
+	ticking bool
+}
+
+type weightRule struct {
+	pattern string
+	weight  float64
+}
+
+type limitedReader struct {
+	l      *limiter
+	r      io.Reader
+	weight float64
+	tokens float64 // guarded by l.mu
+	ready  chan struct{}
+}
+
+// parseRate parses a number of bytes with an optional k, M or G suffix.
+func parseRate(rate string) (float64, error) {
+	s, mult := rate, 1.0
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("%q: bad rate", rate)
+	}
+	return v * mult, nil
+}
+
+func parseWeights(s string) ([]weightRule, error) {
+	var rules []weightRule
+	for _, f := range strings.Split(s, ",") {
+		if f == "" {
+			continue
+		}
+		i := strings.LastIndexByte(f, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%q: expected pattern=weight", f)
+		}
+		w, err := strconv.ParseFloat(f[i+1:], 64)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("%q: bad weight", f)
+		}
+		rules = append(rules, weightRule{f[:i], w})
+	}
+	return rules, nil
+}
+
+func newLimiter(rate, weights string) (*limiter, error) {
+	if rate == "" {
+		if weights != "" {
+			return nil, errors.New("weights make no sense without -r")
+		}
+		return nil, nil
+	}
+	r, err := parseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	w, err := parseWeights(weights)
+	if err != nil {
+		return nil, err
+	}
+	return &limiter{
+		rate:    r,
+		weights: w,
+		waiting: make(map[*limitedReader]bool),
+	}, nil
+}
+
+// weight finds the weight of u: that of the longest matching URL prefix, or
+// failing that, of its host.
+func (l *limiter) weight(u string) float64 {
+	host := ""
+	if pu, err := url.Parse(u); err == nil {
+		host = pu.Hostname()
+	}
+	w, best := 1.0, -1
+	for _, r := range l.weights {
+		switch {
+		case strings.Contains(r.pattern, "://"):
+			if strings.HasPrefix(u, r.pattern) && len(r.pattern) > best {
+				w, best = r.weight, len(r.pattern)
+			}
+		case r.pattern == host && best < 0:
+			w, best = r.weight, 0
+		}
+	}
+	return w
+}
+
+// limitReader puts the body of u under the global rate limit, if any.
+func limitReader(r io.Reader, u string) io.Reader {
+	if limit == nil {
+		return r
+	}
+	return &limitedReader{
+		l:      limit,
+		r:      r,
+		weight: limit.weight(u),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+	n, err := lr.r.Read(p)
+
+	l := lr.l
+	l.mu.Lock()
+	lr.tokens -= float64(n)
+	if lr.tokens >= 0 {
+		l.mu.Unlock()
+		return n, err
+	}
+	l.waiting[lr] = true
+	if !l.ticking {
+		l.ticking = true
+		go l.tick()
+	}
+	l.mu.Unlock()
+
+	<-lr.ready
+	return n, err
+}
+
+// tick hands out bytes to waiting readers for as long as there are any.
+func (l *limiter) tick() {
+	t := time.NewTicker(limitTick)
+	defer t.Stop()
+	last := time.Now()
+
+	for now := range t.C {
+		budget := l.rate * now.Sub(last).Seconds()
+		last = now
+
+		l.mu.Lock()
+		sum := 0.0
+		for lr := range l.waiting {
+			sum += lr.weight
+		}
+		for lr := range l.waiting {
+			lr.tokens += budget * lr.weight / sum
+			if lr.tokens >= 0 {
+				delete(l.waiting, lr)
+				lr.ready <- struct{}{}
+			}
+		}
+		if len(l.waiting) == 0 {
+			l.ticking = false
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,563 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Offline verification of Sigstore bundles.  Nothing is asked of Fulcio or
+// Rekor: the certificate chain, the transparency log keys and the identity
+// we expect are all given up front, and the bundle has to carry both an
+// inclusion proof and a signed entry timestamp for its log entry.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sigstoreRootFlag = flag.String("sigstore-root", "",
+	"verify downloads against URL.sigstore.json bundles, trusting this trusted_root.json")
+var sigstoreIdentityFlag = flag.String("sigstore-identity", "",
+	"regular expression the signer's certificate identity must match")
+var sigstoreIssuerFlag = flag.String("sigstore-issuer", "",
+	"OIDC issuer the signer's certificate must name")
+
+// sigstore is the verification policy, if any.
+var sigstore *sigstorePolicy
+
+// Fulcio certificate extensions naming the OIDC issuer.
+var (
+	oidIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// pbInt is an int64 as protobuf JSON encodes it, usually in a string.
+type pbInt int64
+
+func (n *pbInt) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*n = pbInt(v)
+	return err
+}
+
+type pbBytes struct {
+	RawBytes []byte `json:"rawBytes"`
+}
+
+type sigstoreTrustedRoot struct {
+	Tlogs []struct {
+		BaseURL   string  `json:"baseUrl"`
+		PublicKey pbBytes `json:"publicKey"`
+		LogID     struct {
+			KeyID []byte `json:"keyId"`
+		} `json:"logId"`
+	} `json:"tlogs"`
+	CertificateAuthorities []struct {
+		CertChain struct {
+			Certificates []pbBytes `json:"certificates"`
+		} `json:"certChain"`
+	} `json:"certificateAuthorities"`
+}
+
+type sigstoreTlogEntry struct {
+	LogIndex pbInt `json:"logIndex"`
+	LogID    struct {
+		KeyID []byte `json:"keyId"`
+	} `json:"logId"`
+	KindVersion struct {
+		Kind    string `json:"kind"`
+		Version string `json:"version"`
+	} `json:"kindVersion"`
+	IntegratedTime   pbInt `json:"integratedTime"`
+	InclusionPromise *struct {
+		SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+	} `json:"inclusionPromise"`
+	InclusionProof *struct {
+		LogIndex   pbInt    `json:"logIndex"`
+		RootHash   []byte   `json:"rootHash"`
+		TreeSize   pbInt    `json:"treeSize"`
+		Hashes     [][]byte `json:"hashes"`
+		Checkpoint struct {
+			Envelope string `json:"envelope"`
+		} `json:"checkpoint"`
+	} `json:"inclusionProof"`
+	CanonicalizedBody []byte `json:"canonicalizedBody"`
+}
+
+type sigstoreBundle struct {
+	MediaType            string `json:"mediaType"`
+	VerificationMaterial struct {
+		Certificate          *pbBytes `json:"certificate"`
+		X509CertificateChain *struct {
+			Certificates []pbBytes `json:"certificates"`
+		} `json:"x509CertificateChain"`
+		TlogEntries []sigstoreTlogEntry `json:"tlogEntries"`
+	} `json:"verificationMaterial"`
+	MessageSignature *struct {
+		MessageDigest struct {
+			Algorithm string `json:"algorithm"`
+			Digest    []byte `json:"digest"`
+		} `json:"messageDigest"`
+		Signature []byte `json:"signature"`
+	} `json:"messageSignature"`
+	DsseEnvelope *struct {
+		Payload     []byte `json:"payload"`
+		PayloadType string `json:"payloadType"`
+		Signatures  []struct {
+			Sig []byte `json:"sig"`
+		} `json:"signatures"`
+	} `json:"dsseEnvelope"`
+}
+
+// rekorBody is the part of a Rekor entry body we check against the bundle,
+// for both hashedrekord and dsse entries.
+type rekorBody struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Signature struct {
+			Content   []byte `json:"content"`
+			PublicKey struct {
+				Content []byte `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		PayloadHash struct {
+			Algorithm string `json:"algorithm"`
+			Value     string `json:"value"`
+		} `json:"payloadHash"`
+		Signatures []struct {
+			Signature []byte `json:"signature"`
+			Verifier  []byte `json:"verifier"`
+		} `json:"signatures"`
+	} `json:"spec"`
+}
+
+type sigstoreLog struct {
+	pub    crypto.PublicKey
+	origin string // of its checkpoints, up to any " - " suffix
+}
+
+type sigstorePolicy struct {
+	roots         *x509.CertPool
+	intermediates *x509.CertPool
+	tlogs         map[string]sigstoreLog // by hex log ID
+	identity      *regexp.Regexp
+	issuer        string
+}
+
+func newSigstorePolicy(root, identity, issuer string) (*sigstorePolicy, error) {
+	if identity == "" || issuer == "" {
+		return nil, errors.New(
+			"sigstore: both -sigstore-identity and -sigstore-issuer are needed")
+	}
+	re, err := regexp.Compile("^(?:" + identity + ")$")
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(root)
+	if err != nil {
+		return nil, err
+	}
+	var tr sigstoreTrustedRoot
+	if err = json.Unmarshal(b, &tr); err != nil {
+		return nil, fmt.Errorf("%s: %w", root, err)
+	}
+
+	p := &sigstorePolicy{
+		roots:         x509.NewCertPool(),
+		intermediates: x509.NewCertPool(),
+		tlogs:         make(map[string]sigstoreLog),
+		identity:      re,
+		issuer:        issuer,
+	}
+	for _, ca := range tr.CertificateAuthorities {
+		certs := ca.CertChain.Certificates
+		for i, c := range certs {
+			cert, err := x509.ParseCertificate(c.RawBytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", root, err)
+			}
+			if i == len(certs)-1 {
+				p.roots.AddCert(cert)
+			} else {
+				p.intermediates.AddCert(cert)
+			}
+		}
+	}
+	for _, tl := range tr.Tlogs {
+		pub, err := x509.ParsePKIXPublicKey(tl.PublicKey.RawBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", root, err)
+		}
+		u, err := url.Parse(tl.BaseURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("%s: log without a base URL", root)
+		}
+		p.tlogs[hex.EncodeToString(tl.LogID.KeyID)] = sigstoreLog{pub, u.Host}
+	}
+	if len(p.tlogs) == 0 || len(tr.CertificateAuthorities) == 0 {
+		return nil, fmt.Errorf("%s: no certificate authorities or logs", root)
+	}
+	return p, nil
+}
+
+// sigHash is the hash that signatures by pub are made over: the one
+// matching the curve for ECDSA, and SHA-256 otherwise.
+func sigHash(pub crypto.PublicKey) crypto.Hash {
+	if k, ok := pub.(*ecdsa.PublicKey); ok {
+		switch k.Curve.Params().BitSize {
+		case 384:
+			return crypto.SHA384
+		case 521:
+			return crypto.SHA512
+		}
+	}
+	return crypto.SHA256
+}
+
+// Names of the hashes sigHash gives, in bundles and in Rekor entries.
+var sigstoreHashes = map[crypto.Hash][2]string{
+	crypto.SHA256: {"SHA2_256", "sha256"},
+	crypto.SHA384: {"SHA2_384", "sha384"},
+	crypto.SHA512: {"SHA2_512", "sha512"},
+}
+
+// verifyDigest checks a signature made over a digest by sigHash(pub).
+func verifyDigest(pub crypto.PublicKey, digest, sig []byte) error {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(pub, digest, sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	return errors.New("bad signature")
+}
+
+// fileDigests hashes f with each of the hashes sigHash may pick.
+func fileDigests(f string) (map[crypto.Hash][]byte, error) {
+	fp, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	hs := make(map[crypto.Hash]hash.Hash)
+	var ws []io.Writer
+	for h := range sigstoreHashes {
+		hs[h] = h.New()
+		ws = append(ws, hs[h])
+	}
+	if _, err = io.Copy(io.MultiWriter(ws...), fp); err != nil {
+		return nil, err
+	}
+	d := make(map[crypto.Hash][]byte)
+	for h, hh := range hs {
+		d[h] = hh.Sum(nil)
+	}
+	return d, nil
+}
+
+func fileSHA256(f string) ([]byte, error) {
+	fp, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, fp); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyFile checks the downloaded file f against the bundle published
+// next to u.
+func (p *sigstorePolicy) verifyFile(u, f string) error {
+	b, err := fetchBytes(u+".sigstore.json", 1<<20)
+	if err != nil {
+		return err
+	}
+	digests, err := fileDigests(f)
+	if err != nil {
+		return err
+	}
+	if err = p.verify(b, digests); err != nil {
+		return fmt.Errorf("%s: sigstore: %w", u, err)
+	}
+	if !*qflag {
+		fmt.Println("verified", u, "with sigstore")
+	}
+	return nil
+}
+
+func (p *sigstorePolicy) verify(b []byte, digests map[crypto.Hash][]byte) error {
+	var bn sigstoreBundle
+	if err := json.Unmarshal(b, &bn); err != nil {
+		return err
+	}
+
+	vm := &bn.VerificationMaterial
+	var certs []pbBytes
+	if vm.Certificate != nil {
+		certs = append(certs, *vm.Certificate)
+	} else if vm.X509CertificateChain != nil {
+		certs = vm.X509CertificateChain.Certificates
+	}
+	if len(certs) == 0 {
+		return errors.New("no signing certificate")
+	}
+	leaf, err := x509.ParseCertificate(certs[0].RawBytes)
+	if err != nil {
+		return err
+	}
+	inter := p.intermediates.Clone()
+	for _, c := range certs[1:] {
+		cert, err := x509.ParseCertificate(c.RawBytes)
+		if err != nil {
+			return err
+		}
+		inter.AddCert(cert)
+	}
+	if err = p.checkIdentity(leaf); err != nil {
+		return err
+	}
+
+	// The signature itself, and what the log entry should say about it.
+	var sig []byte
+	var check func(*rekorBody) error
+	switch {
+	case bn.MessageSignature != nil:
+		ms := bn.MessageSignature
+		alg := sigHash(leaf.PublicKey)
+		digest, names := digests[alg], sigstoreHashes[alg]
+		if d := ms.MessageDigest.Digest; d != nil &&
+			(ms.MessageDigest.Algorithm != names[0] ||
+				!bytes.Equal(d, digest)) {
+			return errors.New("message digest mismatch")
+		}
+		sig = ms.Signature
+		if err = verifyDigest(leaf.PublicKey, digest, sig); err != nil {
+			return err
+		}
+		check = func(body *rekorBody) error {
+			h := body.Spec.Data.Hash
+			if body.Kind != "hashedrekord" || h.Algorithm != names[1] ||
+				h.Value != hex.EncodeToString(digest) ||
+				!bytes.Equal(body.Spec.Signature.Content, sig) ||
+				!samePEMCert(body.Spec.Signature.PublicKey.Content, leaf) {
+				return errors.New("log entry doesn't match bundle")
+			}
+			return nil
+		}
+	case bn.DsseEnvelope != nil:
+		env := bn.DsseEnvelope
+		if len(env.Signatures) != 1 {
+			return errors.New("expected exactly one DSSE signature")
+		}
+		sig = env.Signatures[0].Sig
+		pae := dssePAE(env.PayloadType, env.Payload)
+		if err = verifySignature(leaf.PublicKey, pae, sig); err != nil {
+			return err
+		}
+		if err = checkSubject(env.Payload, digests[crypto.SHA256]); err != nil {
+			return err
+		}
+		ph := sha256.Sum256(env.Payload)
+		check = func(body *rekorBody) error {
+			if body.Kind != "dsse" ||
+				body.Spec.PayloadHash.Value != hex.EncodeToString(ph[:]) {
+				return errors.New("log entry doesn't match bundle")
+			}
+			for _, s := range body.Spec.Signatures {
+				if bytes.Equal(s.Signature, sig) &&
+					samePEMCert(s.Verifier, leaf) {
+					return nil
+				}
+			}
+			return errors.New("log entry doesn't match bundle")
+		}
+	default:
+		return errors.New("no signature in bundle")
+	}
+
+	if len(vm.TlogEntries) == 0 {
+		return errors.New("no transparency log entries")
+	}
+	for i := range vm.TlogEntries {
+		e := &vm.TlogEntries[i]
+		if err = p.verifyEntry(e, check); err != nil {
+			return err
+		}
+
+		// Fulcio certificates only live for minutes, so what matters
+		// is that the signature was logged while it was valid.  The
+		// time is the one the log signed in its promise.
+		_, err = leaf.Verify(x509.VerifyOptions{
+			Roots:         p.roots,
+			Intermediates: inter,
+			CurrentTime:   time.Unix(int64(e.IntegratedTime), 0),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *sigstorePolicy) checkIdentity(cert *x509.Certificate) error {
+	var issuer string
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			asn1.Unmarshal(ext.Value, &issuer)
+		case ext.Id.Equal(oidIssuerV1) && issuer == "":
+			issuer = string(ext.Value)
+		}
+	}
+	if issuer != p.issuer {
+		return fmt.Errorf("certificate issuer %q, expected %q",
+			issuer, p.issuer)
+	}
+
+	var ids []string
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, cert.EmailAddresses...)
+	for _, id := range ids {
+		if p.identity.MatchString(id) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate identities %q don't match policy", ids)
+}
+
+func (p *sigstorePolicy) verifyEntry(e *sigstoreTlogEntry, check func(*rekorBody) error) error {
+	tl, ok := p.tlogs[hex.EncodeToString(e.LogID.KeyID)]
+	if !ok {
+		return errors.New("log entry from an unknown log")
+	}
+	pub := tl.pub
+
+	var body rekorBody
+	if err := json.Unmarshal(e.CanonicalizedBody, &body); err != nil {
+		return err
+	}
+	if err := check(&body); err != nil {
+		return err
+	}
+
+	ip := e.InclusionProof
+	if ip == nil {
+		return errors.New("log entry has no inclusion proof")
+	}
+	origin, size, root, err := verifyCheckpoint(ip.Checkpoint.Envelope, pub)
+	if err != nil {
+		return err
+	}
+	if origin != tl.origin && !strings.HasPrefix(origin, tl.origin+" - ") {
+		return fmt.Errorf("checkpoint from %q, expected %q",
+			origin, tl.origin)
+	}
+	if size != uint64(ip.TreeSize) || !bytes.Equal(root, ip.RootHash) {
+		return errors.New("checkpoint doesn't match inclusion proof")
+	}
+	err = verifyInclusion(uint64(ip.LogIndex), uint64(ip.TreeSize),
+		leafHash(e.CanonicalizedBody), ip.Hashes, ip.RootHash)
+	if err != nil {
+		return err
+	}
+
+	// Without the log's promise, the integrated time is only the
+	// bundle's word, and it is what the certificate is checked at.
+	if e.InclusionPromise == nil {
+		return errors.New("log entry has no signed entry timestamp")
+	}
+	set, _ := json.Marshal(map[string]interface{}{
+		"body":           base64.StdEncoding.EncodeToString(e.CanonicalizedBody),
+		"integratedTime": int64(e.IntegratedTime),
+		"logID":          hex.EncodeToString(e.LogID.KeyID),
+		"logIndex":       int64(e.LogIndex),
+	})
+	if set, err = canonicalJSON(set); err != nil {
+		return err
+	}
+	err = verifySignature(pub, set, e.InclusionPromise.SignedEntryTimestamp)
+	if err != nil {
+		return fmt.Errorf("signed entry timestamp: %w", err)
+	}
+	return nil
+}
+
+func samePEMCert(b []byte, cert *x509.Certificate) bool {
+	blk, _ := pem.Decode(b)
+	return blk != nil && bytes.Equal(blk.Bytes, cert.Raw)
+}
+
+// dssePAE is the DSSE pre-authentication encoding, which is what gets
+// signed.
+func dssePAE(typ string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s",
+		len(typ), typ, len(payload), payload))
+}
+
+// checkSubject checks that an in-toto statement is about a file with the
+// given SHA-256 digest.
+func checkSubject(payload, digest []byte) error {
+	var st struct {
+		Subject []struct {
+			Digest map[string]string `json:"digest"`
+		} `json:"subject"`
+	}
+	if err := json.Unmarshal(payload, &st); err != nil {
+		return err
+	}
+	for _, s := range st.Subject {
+		if s.Digest["sha256"] == hex.EncodeToString(digest) {
+			return nil
+		}
+	}
+	return errors.New("artifact isn't a subject of the attestation")
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// TCP tuning for long fat pipes.  Every connection to a server is made by
+// dial, so that the options apply whatever the protocol.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+)
+
+var sndbufFlag = flag.Int("sndbuf", 0, "TCP send buffer size in bytes")
+var rcvbufFlag = flag.Int("rcvbuf", 0, "TCP receive buffer size in bytes")
+var tcpCCFlag = flag.String("tcp-congestion", "",
+	"TCP congestion control algorithm, such as bbr or cubic")
+var keepaliveFlag = flag.Duration("keepalive", 0,
+	"idle time before TCP keepalive probes, or negative to turn them off")
+var keepaliveIntvlFlag = flag.Duration("keepalive-interval", 0,
+	"time between TCP keepalive probes")
+var keepaliveCountFlag = flag.Int("keepalive-count", 0,
+	"unanswered TCP keepalive probes before the connection is dropped")
+var nodelayFlag = flag.Bool("nodelay", true,
+	"send small TCP segments without waiting (TCP_NODELAY)")
+var mptcpFlag = flag.Bool("mptcp", false, "use Multipath TCP where available")
+
+// dial connects to addr with the options above.  main sets it up.
+var dial = (&net.Dialer{Timeout: 30 * time.Second}).DialContext
+
+// newDial makes the dial function from the command line options.
+func newDial() (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	for _, n := range []int{*sndbufFlag, *rcvbufFlag, *keepaliveCountFlag} {
+		if n < 0 {
+			return nil, fmt.Errorf("%d: TCP options can't be negative", n)
+		}
+	}
+	if *keepaliveIntvlFlag < 0 {
+		return nil, fmt.Errorf("%v: negative -keepalive-interval",
+			*keepaliveIntvlFlag)
+	}
+
+	d := &net.Dialer{
+		Timeout: 30 * time.Second,
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   *keepaliveFlag >= 0,
+			Idle:     *keepaliveFlag,
+			Interval: *keepaliveIntvlFlag,
+			Count:    *keepaliveCountFlag,
+		},
+		Control: sockControl,
+	}
+	if *keepaliveFlag < 0 {
+		d.KeepAlive = -1
+	}
+	d.SetMultipathTCP(*mptcpFlag)
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tc, ok := c.(*net.TCPConn); ok {
+			// The dialer always turns Nagle off, so it can only be
+			// turned back on once connected.
+			if err = tc.SetNoDelay(*nodelayFlag); err == nil {
+				err = tuneConn(tc)
+			}
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		return c, nil
+	}, nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// sockControl sets the options that have to be there before connecting.
+// The receive buffer size in particular decides the window scale offered
+// in the SYN.
+func sockControl(network, addr string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		s := int(fd)
+		if *sndbufFlag > 0 {
+			err = syscall.SetsockoptInt(s, syscall.SOL_SOCKET,
+				syscall.SO_SNDBUF, *sndbufFlag)
+		}
+		if err == nil && *rcvbufFlag > 0 {
+			err = syscall.SetsockoptInt(s, syscall.SOL_SOCKET,
+				syscall.SO_RCVBUF, *rcvbufFlag)
+		}
+		if err == nil && *tcpCCFlag != "" {
+			err = syscall.SetsockoptString(s, syscall.IPPROTO_TCP,
+				syscall.TCP_CONGESTION, *tcpCCFlag)
+			if err != nil {
+				err = fmt.Errorf("TCP congestion control %q: %w",
+					*tcpCCFlag, err)
+			}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func tuneConn(tc *net.TCPConn) error {
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// sockControl can't choose the congestion control anywhere but Linux.
+func sockControl(network, addr string, c syscall.RawConn) error {
+	if *tcpCCFlag != "" {
+		return errors.New("-tcp-congestion is only supported on Linux")
+	}
+	return nil
+}
+
+// tuneConn sets the buffer sizes, which here has to wait until the
+// connection is made.
+func tuneConn(tc *net.TCPConn) error {
+	if *sndbufFlag > 0 {
+		if err := tc.SetWriteBuffer(*sndbufFlag); err != nil {
+			return err
+		}
+	}
+	if *rcvbufFlag > 0 {
+		return tc.SetReadBuffer(*rcvbufFlag)
+	}
+	return nil
+}
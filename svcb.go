@@ -0,0 +1,313 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// HTTPS records (RFC 9460): where to connect to for an https origin, with
+// what ALPN, and with what Encrypted Client Hello configuration.  HTTP/3
+// can't be spoken here, so endpoints offering nothing else are passed
+// over.
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var svcbFlag = flag.Bool("svcb", false,
+	"look up HTTPS DNS records, and use Encrypted Client Hello when they offer it")
+
+const (
+	svcbMaxAlias = 8
+	// How long a failed lookup is remembered, so that every connection
+	// to a host doesn't wait out the same DNS timeouts.
+	svcbRetry = 30 * time.Second
+)
+
+// SvcParamKeys
+const (
+	svcbALPN          = 1
+	svcbNoDefaultALPN = 2
+	svcbPort          = 3
+	svcbIPv4Hint      = 4
+	svcbECH           = 5
+	svcbIPv6Hint      = 6
+)
+
+type svcbRecord struct {
+	priority      uint16
+	target        string
+	alpn          []string
+	noDefaultALPN bool
+	port          int
+	hints         []net.IP
+	ech           []byte
+}
+
+func parseSVCB(rr dnsRR) (*svcbRecord, error) {
+	d := rr.data
+	if len(d) < 3 {
+		return nil, errDNSFormat
+	}
+	r := &svcbRecord{priority: binary.BigEndian.Uint16(d)}
+	target, end, err := readName(rr.msg, rr.off+2)
+	if err != nil || end > rr.off+len(d) {
+		return nil, errDNSFormat
+	}
+	r.target = target
+	d = d[end-rr.off:]
+
+	for len(d) > 0 {
+		if len(d) < 4 {
+			return nil, errDNSFormat
+		}
+		key := binary.BigEndian.Uint16(d)
+		n := int(binary.BigEndian.Uint16(d[2:]))
+		if len(d) < 4+n {
+			return nil, errDNSFormat
+		}
+		v := d[4 : 4+n]
+		d = d[4+n:]
+
+		switch key {
+		case svcbALPN:
+			for len(v) > 0 {
+				l := int(v[0])
+				if len(v) < 1+l {
+					return nil, errDNSFormat
+				}
+				r.alpn = append(r.alpn, string(v[1:1+l]))
+				v = v[1+l:]
+			}
+		case svcbNoDefaultALPN:
+			r.noDefaultALPN = true
+		case svcbPort:
+			if len(v) != 2 {
+				return nil, errDNSFormat
+			}
+			r.port = int(binary.BigEndian.Uint16(v))
+		case svcbIPv4Hint, svcbIPv6Hint:
+			size := net.IPv4len
+			if key == svcbIPv6Hint {
+				size = net.IPv6len
+			}
+			for ; len(v) >= size; v = v[size:] {
+				r.hints = append(r.hints, net.IP(v[:size]))
+			}
+		case svcbECH:
+			r.ech = v
+		}
+	}
+	return r, nil
+}
+
+// protos returns the ALPN protocols of r we can speak.
+func (r *svcbRecord) protos() []string {
+	var p []string
+	for _, a := range r.alpn {
+		if a == "h2" || a == "http/1.1" {
+			p = append(p, a)
+		}
+	}
+	if !r.noDefaultALPN && !contains(p, "http/1.1") {
+		p = append(p, "http/1.1")
+	}
+	return p
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+type svcbDialer struct {
+	tlsDialer
+
+	mu      sync.Mutex
+	records map[string]svcbLookup // by host:port
+}
+
+type svcbLookup struct {
+	recs  []svcbRecord
+	err   error
+	until time.Time // for failures
+}
+
+// lookup finds the service-mode HTTPS records for host and port, in order
+// of priority.  Answers are kept for the rest of the run, and failures for
+// svcbRetry.
+func (d *svcbDialer) lookup(host, port string) ([]svcbRecord, error) {
+	key := net.JoinHostPort(host, port)
+	d.mu.Lock()
+	l, ok := d.records[key]
+	d.mu.Unlock()
+	if ok && (l.err == nil || time.Now().Before(l.until)) {
+		return l.recs, l.err
+	}
+
+	recs, err := d.query(host, port)
+	l = svcbLookup{recs: recs, err: err}
+	if err != nil {
+		l.recs, l.until = nil, time.Now().Add(svcbRetry)
+	}
+	d.mu.Lock()
+	d.records[key] = l
+	d.mu.Unlock()
+	return l.recs, l.err
+}
+
+// query asks the DNS for the HTTPS records of host and port, following
+// alias-mode ones.
+func (d *svcbDialer) query(host, port string) ([]svcbRecord, error) {
+	var recs []svcbRecord
+	if net.ParseIP(host) == nil {
+		name := host
+		if port != "443" {
+			name = "_" + port + "._https." + host
+		}
+		for i := 0; i < svcbMaxAlias; i++ {
+			r, err := dnsQuery(name, dnsTypeHTTPS)
+			if err != nil {
+				return nil, err
+			}
+			var alias string
+			recs = recs[:0]
+			for _, rr := range r.answers {
+				if rr.typ != dnsTypeHTTPS {
+					continue
+				}
+				s, err := parseSVCB(rr)
+				if err != nil {
+					return nil, err
+				}
+				if s.priority == 0 {
+					alias = s.target
+				} else {
+					recs = append(recs, *s)
+				}
+			}
+			if len(recs) > 0 || alias == "" || alias == "." {
+				break
+			}
+			name = alias
+		}
+		sort.SliceStable(recs, func(i, j int) bool {
+			return recs[i].priority < recs[j].priority
+		})
+	}
+	return recs, nil
+}
+
+// dialTLS connects to addr by the first of its HTTPS records that works,
+// or directly if there are none.
+func (d *svcbDialer) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	// Without HTTPS records, or if they can't be looked up, the
+	// connection is made as it would be otherwise.
+	recs, err := d.lookup(host, port)
+	if err != nil || len(recs) == 0 {
+		return d.tlsDialer.dialTLS(ctx, network, addr)
+	}
+
+	err = fmt.Errorf("%s: no usable HTTPS record", host)
+	for _, r := range recs {
+		protos := r.protos()
+		if len(protos) == 0 {
+			continue // h3 only
+		}
+		target := strings.TrimSuffix(r.target, ".")
+		if target == "" {
+			target = host
+		}
+		p := port
+		if r.port != 0 {
+			p = strconv.Itoa(r.port)
+		}
+
+		cfg := d.tls.Clone()
+		cfg.ServerName = host
+		cfg.NextProtos = protos
+		cfg.EncryptedClientHelloConfigList = r.ech
+		cfg = hostKeys.config(cfg, addr)
+		// TLSA records belong to the endpoint rather than the origin.
+		if cfg, err = daneConfig(cfg, target, p); err != nil {
+			return nil, err
+		}
+
+		addrs := []string{net.JoinHostPort(target, p)}
+		if _, lerr := net.DefaultResolver.LookupHost(ctx, target); lerr != nil {
+			addrs = addrs[:0]
+			for _, ip := range r.hints {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), p))
+			}
+		}
+		for _, a := range addrs {
+			var c net.Conn
+			if c, err = d.handshake(ctx, network, a, cfg); err == nil {
+				return c, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+// svcbUpgrader sends plain http requests over https when the origin has
+// HTTPS records, as RFC 9460 asks.
+type svcbUpgrader struct {
+	d  *svcbDialer
+	rt http.RoundTripper
+}
+
+func (u *svcbUpgrader) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return u.rt.RoundTrip(req)
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	host := req.URL.Hostname()
+	if port == "80" {
+		port = "443"
+	}
+	recs, err := u.d.lookup(host, port)
+	if err != nil || len(recs) == 0 {
+		return u.rt.RoundTrip(req)
+	}
+
+	r := req.Clone(req.Context())
+	r.URL.Scheme = "https"
+	if port == "443" {
+		r.URL.Host = host
+		if strings.Contains(host, ":") {
+			r.URL.Host = "[" + host + "]"
+		}
+	}
+	return u.rt.RoundTrip(r)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// Transparency log helpers: RFC 6962 Merkle tree hashing and inclusion
+// proofs, and checkpoints in the signed note format.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+func leafHash(b []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func nodeHash(l, r []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(l)
+	h.Write(r)
+	return h.Sum(nil)
+}
+
+// verifyInclusion checks that leaf is at index in the tree of the given
+// size with the given root hash.
+func verifyInclusion(index, size uint64, leaf []byte, proof [][]byte, root []byte) error {
+	if index >= size {
+		return errors.New("inclusion proof: index beyond tree size")
+	}
+	inner := bits.Len64(index ^ (size - 1))
+	border := bits.OnesCount64(index >> uint(inner))
+	if len(proof) != inner+border {
+		return errors.New("inclusion proof: wrong length")
+	}
+
+	h := leaf
+	for i, p := range proof[:inner] {
+		if (index>>uint(i))&1 == 0 {
+			h = nodeHash(h, p)
+		} else {
+			h = nodeHash(p, h)
+		}
+	}
+	for _, p := range proof[inner:] {
+		h = nodeHash(p, h)
+	}
+	if !bytes.Equal(h, root) {
+		return errors.New("inclusion proof: root hash mismatch")
+	}
+	return nil
+}
+
+// verifyNote checks that a signed note carries a valid signature by pub,
+// and returns its text.  Signature lines look like
+//
+//	— name base64(keyhash[4] || signature)
+//
+// and since we know which key we want, the key hashes aren't looked at.
+func verifyNote(note string, pub crypto.PublicKey) (string, error) {
+	text, sigs, ok := strings.Cut(note, "\n\n")
+	if !ok {
+		return "", errors.New("note: no signatures")
+	}
+	text += "\n"
+
+	for _, line := range strings.Split(sigs, "\n") {
+		line, ok := strings.CutPrefix(line, "— ")
+		if !ok {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(line[i+1:])
+		if err != nil || len(b) <= 4 {
+			continue
+		}
+		if verifySignature(pub, []byte(text), b[4:]) == nil {
+			return text, nil
+		}
+	}
+	return "", errors.New("note: no valid signature")
+}
+
+// verifyCheckpoint checks a signed checkpoint, and returns the origin, tree
+// size and root hash it commits to.
+func verifyCheckpoint(note string, pub crypto.PublicKey) (string, uint64, []byte, error) {
+	text, err := verifyNote(note, pub)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	lines := strings.Split(text, "\n")
+	if len(lines) < 4 {
+		return "", 0, nil, errors.New("checkpoint: too short")
+	}
+	size, err := strconv.ParseUint(lines[1], 10, 64)
+	if err != nil {
+		return "", 0, nil, errors.New("checkpoint: bad tree size")
+	}
+	root, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(root) != sha256.Size {
+		return "", 0, nil, errors.New("checkpoint: bad root hash")
+	}
+	return lines[0], size, root, nil
+}
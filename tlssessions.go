@@ -0,0 +1,182 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// TLS sessions kept on disk, so that the next run can resume them instead
+// of doing a full handshake.  The file holds session secrets, so it is
+// only ever readable by its owner.
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var tlsSessionsFlag = flag.String("tls-sessions", "",
+	"keep TLS sessions in this file, to be resumed by later runs")
+var tlsSessionLifetimeFlag = flag.Duration("tls-session-lifetime",
+	24*time.Hour, "how long to keep TLS sessions for")
+
+// sessions is the session cache, if there is one.
+var sessions *sessionCache
+
+type tlsSession struct {
+	Ticket  []byte    `json:"ticket"`
+	State   []byte    `json:"state"`
+	Expires time.Time `json:"expires"`
+}
+
+// sessionCache is a tls.ClientSessionCache that remembers what changed,
+// so that it can be merged with what other runs saved meanwhile.
+type sessionCache struct {
+	path string
+
+	mu       sync.Mutex
+	sessions map[string]*tlsSession
+	changed  map[string]bool
+}
+
+// readSessions reads the session file, which must not be accessible to
+// anyone but its owner.  A missing file is an empty one.
+func readSessions(path string) (map[string]*tlsSession, error) {
+	m := make(map[string]*tlsSession)
+	fp, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s: accessible by others, not using it",
+			path)
+	}
+	if err = json.NewDecoder(fp).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+func newSessionCache(path string) (*sessionCache, error) {
+	c := &sessionCache{path: path, changed: make(map[string]bool)}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	m, err := readSessions(path)
+	if err != nil {
+		// Start afresh; saving puts things right.
+		fmt.Fprintln(os.Stderr, err)
+		m = make(map[string]*tlsSession)
+	}
+	c.sessions = m
+	return c, nil
+}
+
+func (c *sessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	s, ok := c.sessions[key]
+	c.mu.Unlock()
+	if !ok || time.Now().After(s.Expires) {
+		return nil, false
+	}
+	st, err := tls.ParseSessionState(s.State)
+	if err != nil {
+		return nil, false
+	}
+	cs, err := tls.NewResumptionState(s.Ticket, st)
+	if err != nil {
+		return nil, false
+	}
+	return cs, true
+}
+
+// Put stores cs under key, or with a nil cs, removes what is there.
+func (c *sessionCache) Put(key string, cs *tls.ClientSessionState) {
+	var s *tlsSession
+	if cs != nil {
+		ticket, st, err := cs.ResumptionState()
+		if err != nil || st == nil {
+			return
+		}
+		b, err := st.Bytes()
+		if err != nil {
+			return
+		}
+		s = &tlsSession{ticket, b, time.Now().Add(*tlsSessionLifetimeFlag)}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s == nil {
+		delete(c.sessions, key)
+	} else {
+		c.sessions[key] = s
+	}
+	c.changed[key] = true
+}
+
+// save writes out the sessions, along with those other runs have saved
+// since we read the file.  Expired ones are dropped.
+func (c *sessionCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.changed) == 0 {
+		return nil
+	}
+
+	lk, err := lockFile(c.path+".lock", 0600, true)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lk, false)
+
+	m, err := readSessions(c.path)
+	if err != nil {
+		m = make(map[string]*tlsSession)
+	}
+	for k := range c.changed {
+		if s, ok := c.sessions[k]; ok {
+			m[k] = s
+		} else {
+			delete(m, k)
+		}
+	}
+	now := time.Now()
+	for k, s := range m {
+		if now.After(s.Expires) {
+			delete(m, k)
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, b, 0600)
+}
@@ -0,0 +1,362 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// OpenTelemetry tracing.  Spans are kept until goget is done, and then
+// sent to the collector in one go, as OTLP/HTTP with JSON encoding.  The
+// whole run is one span, with a span for each download under it, and
+// under those, one for each HTTP request, redirects included.  The DNS
+// lookups, connections and TLS handshakes the requests needed are below
+// them.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var otlpFlag = flag.String("otlp", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+	"send OpenTelemetry traces to this OTLP/HTTP collector")
+
+// Span kinds
+const (
+	spanInternal = 1
+	spanClient   = 3
+)
+
+// otlpClient sends the spans.  Not client, which would only trace this
+// as well.  A collector that doesn't answer mustn't hold up the exit.
+var otlpClient = &http.Client{Timeout: 10 * time.Second}
+
+// tracer collects the spans, if tracing was asked for.
+var tracer *spanTracer
+
+type spanTracer struct {
+	endpoint string
+	root     *span
+
+	mu    sync.Mutex
+	spans []*span
+}
+
+type span struct {
+	t       *spanTracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []otlpAttr
+	err     error
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+// newTracer starts tracing a run called name.  If the environment has a
+// W3C TRACEPARENT, the run is part of that trace.
+func newTracer(endpoint, name string) *spanTracer {
+	t := &spanTracer{endpoint: strings.TrimSuffix(endpoint, "/")}
+	t.root = t.start(nil, name, spanInternal)
+	if tid, pid, ok := parseTraceparent(os.Getenv("TRACEPARENT")); ok {
+		t.root.traceID, t.root.parent = tid, pid
+	}
+	return t
+}
+
+func parseTraceparent(s string) (tid [16]byte, pid [8]byte, ok bool) {
+	f := strings.Split(s, "-")
+	if len(f) != 4 || f[0] != "00" {
+		return tid, pid, false
+	}
+	if n, err := hex.Decode(tid[:], []byte(f[1])); err != nil || n != 16 {
+		return tid, pid, false
+	}
+	if n, err := hex.Decode(pid[:], []byte(f[2])); err != nil || n != 8 {
+		return tid, pid, false
+	}
+	return tid, pid, true
+}
+
+// start starts a span under parent, or a new trace if there's none.
+func (t *spanTracer) start(parent *span, name string, kind int) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{t: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.id[:])
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parent = parent.id
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	return s
+}
+
+// child starts a span under s.  Like the other span methods, it does
+// nothing when there is no tracing.
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	return s.t.start(s, name, kind)
+}
+
+func (s *span) set(key string, v any) {
+	if s == nil {
+		return
+	}
+	var val otlpValue
+	switch v := v.(type) {
+	case int:
+		str := strconv.Itoa(v)
+		val.IntValue = &str
+	case int64:
+		str := strconv.FormatInt(v, 10)
+		val.IntValue = &str
+	default:
+		str := fmt.Sprint(v)
+		val.StringValue = &str
+	}
+	s.attrs = append(s.attrs, otlpAttr{key, val})
+}
+
+// finish ends s, failed if err isn't nil.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.t.mu.Lock()
+	s.t.spans = append(s.t.spans, s)
+	s.t.mu.Unlock()
+}
+
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" +
+		hex.EncodeToString(s.id[:]) + "-01"
+}
+
+type spanKey struct{}
+
+func withSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// spanFrom returns the span of ctx, or else the one for the whole run.
+func spanFrom(ctx context.Context) *span {
+	if s, ok := ctx.Value(spanKey{}).(*span); ok {
+		return s
+	}
+	if tracer == nil {
+		return nil
+	}
+	return tracer.root
+}
+
+// finish ends the run and sends all the spans off to the collector.
+func (t *spanTracer) finish(err error) error {
+	if t == nil {
+		return nil
+	}
+	t.root.finish(err)
+
+	type otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+		Status       otlpStatus `json:"status"`
+	}
+	// Connections still being made may yet add spans of their own.
+	t.mu.Lock()
+	all := append([]*span(nil), t.spans...)
+	t.mu.Unlock()
+	var spans []otlpSpan
+	for _, s := range all {
+		o := otlpSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.id[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: s.attrs,
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{2, s.err.Error()}
+		}
+		spans = append(spans, o)
+	}
+
+	service := "goget"
+	body := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttr{
+					{"service.name", otlpValue{StringValue: &service}},
+				},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "goget"},
+				"spans": spans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := otlpClient.Post(t.endpoint+"/v1/traces", "application/json",
+		bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return &statusError{t.endpoint, resp.StatusCode, resp.Status}
+	}
+	return nil
+}
+
+// traceTransport makes a span of every request, with spans for the DNS
+// lookups, connections and TLS handshakes done for it, and passes the
+// trace on to the server in a traceparent header.
+type traceTransport struct {
+	rt http.RoundTripper
+}
+
+func (tt *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := spanFrom(req.Context()).child(req.Method, spanClient)
+	if s == nil {
+		return tt.rt.RoundTrip(req)
+	}
+	s.set("http.request.method", req.Method)
+	s.set("url.full", req.URL.String())
+	s.set("server.address", req.URL.Hostname())
+	// Requests following redirects carry the response that led to them.
+	n := 0
+	for r := req.Response; r != nil && r.Request != nil; r = r.Request.Response {
+		n++
+	}
+	if n > 0 {
+		s.set("http.request.resend_count", n)
+	}
+
+	var mu sync.Mutex
+	var dns, tlsSpan *span
+	var shook bool // a handshake went through
+	conns := make(map[string]*span)
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(i httptrace.DNSStartInfo) {
+			mu.Lock()
+			dns = s.child("DNS "+i.Host, spanClient)
+			mu.Unlock()
+		},
+		DNSDone: func(i httptrace.DNSDoneInfo) {
+			mu.Lock()
+			dns.finish(i.Err)
+			mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			c := s.child("connect "+addr, spanClient)
+			c.set("network.transport", network)
+			mu.Lock()
+			conns[network+addr] = c
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			conns[network+addr].finish(err)
+			mu.Unlock()
+		},
+		// Our own dialers report their handshakes as they do them,
+		// and then the transport reports them again, done; those
+		// are left out.
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsSpan = nil
+			if !shook {
+				tlsSpan = s.child("TLS handshake", spanClient)
+			}
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			mu.Lock()
+			if err == nil {
+				tlsSpan.set("tls.protocol.version",
+					tls.VersionName(cs.Version))
+				shook = true
+			}
+			tlsSpan.finish(err)
+			tlsSpan = nil
+			mu.Unlock()
+		},
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	req = req.Clone(ctx)
+	req.Header.Set("traceparent", s.traceparent())
+
+	resp, err := tt.rt.RoundTrip(req)
+	serr := err
+	if err == nil {
+		s.set("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 400 {
+			serr = errors.New(resp.Status)
+		}
+	}
+	s.finish(serr)
+	return resp, err
+}
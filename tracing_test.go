@@ -0,0 +1,185 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testOTLPSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Status       struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+// testCollector is an OTLP/HTTP collector that passes on the spans it
+// is sent.
+func testCollector(t *testing.T) (*httptest.Server, <-chan []testOTLPSpan) {
+	got := make(chan []testOTLPSpan, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []testOTLPSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		var spans []testOTLPSpan
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+		got <- spans
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+// TestTraceSpans traces a request, with the transport doing the TLS
+// handshake and with our own dialer doing it, as with -svcb or -dane.
+func TestTraceSpans(t *testing.T) {
+	t.Run("transport", func(t *testing.T) { testTraceSpans(t, false, false) })
+	t.Run("dialer", func(t *testing.T) { testTraceSpans(t, true, false) })
+	t.Run("dialer failing", func(t *testing.T) { testTraceSpans(t, true, true) })
+}
+
+func testTraceSpans(t *testing.T, dialer, fail bool) {
+	collector, got := testCollector(t)
+	header := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header <- r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+	// A name, so that there is a DNS lookup, and one the test
+	// certificate is good for.
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	tr := srv.Client().Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig.ServerName = "example.com"
+	if dialer {
+		// The dialer asks for localhost, which the certificate
+		// isn't for, so it fails unless told not to verify it.
+		tr.TLSClientConfig.InsecureSkipVerify = !fail
+		td := &tlsDialer{tls: tr.TLSClientConfig, dial: tr.DialContext}
+		if td.dial == nil {
+			td.dial = (&net.Dialer{}).DialContext
+		}
+		tr.DialTLSContext = td.dialTLS
+	}
+
+	old := tracer
+	tracer = newTracer(collector.URL, "test")
+	defer func() { tracer = old }()
+	c := &http.Client{Transport: &traceTransport{tr}}
+	s := spanFrom(context.Background()).child("download", spanInternal)
+	req, err := http.NewRequestWithContext(withSpan(context.Background(), s),
+		"GET", "https://localhost:"+port+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if (err != nil) != fail {
+		t.Fatal(err)
+	}
+	s.finish(nil)
+	if err = tracer.finish(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := <-got
+	byName := make(map[string]testOTLPSpan)
+	for _, sp := range spans {
+		name, _, _ := strings.Cut(sp.Name, " ")
+		if _, ok := byName[name]; ok && name == "TLS" {
+			t.Error("two TLS handshake spans for one handshake")
+		}
+		byName[name] = sp
+	}
+	if failed := byName["TLS"].Status.Code == 2; failed != fail {
+		t.Errorf("TLS handshake span failed: %v", failed)
+	}
+	parents := map[string]string{
+		"test":     "",
+		"download": "test",
+		"GET":      "download",
+		"DNS":      "GET",
+		"connect":  "GET",
+		"TLS":      "GET",
+	}
+	for name, parent := range parents {
+		sp, ok := byName[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if sp.TraceID != byName["test"].TraceID {
+			t.Errorf("%s span is in another trace", name)
+		}
+		if parent != "" && sp.ParentSpanID != byName[parent].SpanID {
+			t.Errorf("%s span is not under %s", name, parent)
+		}
+	}
+	if fail {
+		return
+	}
+	want := "00-" + byName["GET"].TraceID + "-" + byName["GET"].SpanID + "-01"
+	if h := <-header; h != want {
+		t.Errorf("traceparent %q, expected %q", h, want)
+	}
+}
+
+func TestTraceCollectorTimeout(t *testing.T) {
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stop
+	}))
+	defer srv.Close()
+	defer close(stop)
+	defer func(d time.Duration) { otlpClient.Timeout = d }(otlpClient.Timeout)
+	otlpClient.Timeout = 100 * time.Millisecond
+
+	done := make(chan error)
+	go func() { done <- newTracer(srv.URL, "test").finish(nil) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("no error from a collector that never answered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting for the collector")
+	}
+}
@@ -0,0 +1,825 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// A client for The Update Framework, following the detailed client
+// workflow of the TUF specification, version 1.0.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default upper bounds on metadata sizes, for when nothing else tells us
+// how long a file should be.
+const (
+	tufMaxRoot       = 512000
+	tufMaxTimestamp  = 16384
+	tufMaxSnapshot   = 2000000
+	tufMaxTargets    = 5000000
+	tufMaxRotations  = 256
+	tufMaxDelegation = 32
+)
+
+type tufKey struct {
+	Keytype string `json:"keytype"`
+	Scheme  string `json:"scheme"`
+	Keyval  struct {
+		Public string `json:"public"`
+	} `json:"keyval"`
+}
+
+type tufRole struct {
+	KeyIDs    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+type tufEnvelope struct {
+	Signatures []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+	Signed json.RawMessage `json:"signed"`
+}
+
+type tufCommon struct {
+	Type    string    `json:"_type"`
+	Version int64     `json:"version"`
+	Expires time.Time `json:"expires"`
+}
+
+type tufRoot struct {
+	tufCommon
+	ConsistentSnapshot bool               `json:"consistent_snapshot"`
+	Keys               map[string]tufKey  `json:"keys"`
+	Roles              map[string]tufRole `json:"roles"`
+}
+
+type tufFileInfo struct {
+	Version int64             `json:"version"`
+	Length  int64             `json:"length"`
+	Hashes  map[string]string `json:"hashes"`
+}
+
+// tufMeta is either timestamp or snapshot metadata.
+type tufMeta struct {
+	tufCommon
+	Meta map[string]tufFileInfo `json:"meta"`
+}
+
+type tufDelegation struct {
+	Name             string   `json:"name"`
+	KeyIDs           []string `json:"keyids"`
+	Threshold        int      `json:"threshold"`
+	Terminating      bool     `json:"terminating"`
+	Paths            []string `json:"paths"`
+	PathHashPrefixes []string `json:"path_hash_prefixes"`
+}
+
+type tufTargets struct {
+	tufCommon
+	Targets     map[string]tufFileInfo `json:"targets"`
+	Delegations *struct {
+		Keys  map[string]tufKey `json:"keys"`
+		Roles []tufDelegation   `json:"roles"`
+	} `json:"delegations"`
+}
+
+// canonicalJSON re-encodes a JSON document as OLPC canonical JSON, which
+// is what TUF signatures are made over.
+func canonicalJSON(raw []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeCanonical(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return fmt.Errorf("canonical json: non-integer %s", v)
+		}
+		buf.WriteString(strconv.FormatInt(n, 10))
+	case string:
+		buf.WriteByte('"')
+		for i := 0; i < len(v); i++ {
+			if v[i] == '"' || v[i] == '\\' {
+				buf.WriteByte('\\')
+			}
+			buf.WriteByte(v[i])
+		}
+		buf.WriteByte('"')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeCanonical(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			encodeCanonical(buf, k)
+			buf.WriteByte(':')
+			if err := encodeCanonical(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("canonical json: unexpected %T", v)
+	}
+	return nil
+}
+
+// parsePublicKey parses a PEM-encoded PKIX public key.
+func parsePublicKey(s string) (crypto.PublicKey, error) {
+	blk, _ := pem.Decode([]byte(s))
+	if blk == nil {
+		return nil, errors.New("no PEM public key found")
+	}
+	return x509.ParsePKIXPublicKey(blk.Bytes)
+}
+
+// verifySignature checks sig over msg by any of the key types we know.
+// ECDSA signatures are made over the digest of msg by the hash that goes
+// with the curve, and RSA ones over its SHA-256 digest.
+func verifySignature(pub crypto.PublicKey, msg, sig []byte) error {
+	ok := false
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, msg, sig)
+	case *ecdsa.PublicKey:
+		h := sigHash(pub).New()
+		h.Write(msg)
+		ok = ecdsa.VerifyASN1(pub, h.Sum(nil), sig)
+	case *rsa.PublicKey:
+		h := sha256.Sum256(msg)
+		err := rsa.VerifyPSS(pub, crypto.SHA256, h[:], sig,
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		if err != nil {
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig)
+		}
+		ok = err == nil
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	if !ok {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func (k tufKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Keytype {
+	case "ed25519":
+		b, err := hex.DecodeString(k.Keyval.Public)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, errors.New("bad ed25519 key")
+		}
+		return ed25519.PublicKey(b), nil
+	case "ecdsa", "ecdsa-sha2-nistp256", "rsa":
+		return parsePublicKey(k.Keyval.Public)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Keytype)
+}
+
+// tufVerify checks that env is signed by at least the threshold of distinct
+// keys of role.
+func tufVerify(env *tufEnvelope, keys map[string]tufKey, role tufRole) error {
+	if role.Threshold < 1 {
+		return errors.New("role threshold less than 1")
+	}
+	msg, err := canonicalJSON(env.Signed)
+	if err != nil {
+		return err
+	}
+
+	allowed := make(map[string]bool)
+	for _, id := range role.KeyIDs {
+		allowed[id] = true
+	}
+	// The same key may be listed under several key IDs, so signatures
+	// are counted by the key itself.
+	good := make(map[string]bool)
+	for _, s := range env.Signatures {
+		if !allowed[s.KeyID] {
+			continue
+		}
+		k, ok := keys[s.KeyID]
+		if !ok {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil || good[string(der)] {
+			continue
+		}
+		sig, err := hex.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		if verifySignature(pub, msg, sig) == nil {
+			good[string(der)] = true
+		}
+	}
+	if len(good) < role.Threshold {
+		return fmt.Errorf("%d of %d required signatures",
+			len(good), role.Threshold)
+	}
+	return nil
+}
+
+// tufParse verifies the metadata in b with the given keys and role, and
+// decodes it into v, which must be of the given type.
+func tufParse(b []byte, typ string, keys map[string]tufKey, role tufRole, v interface{}) error {
+	var env tufEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return err
+	}
+	if err := tufVerify(&env, keys, role); err != nil {
+		return fmt.Errorf("%s: %w", typ, err)
+	}
+	if err := json.Unmarshal(env.Signed, v); err != nil {
+		return err
+	}
+
+	var c tufCommon
+	json.Unmarshal(env.Signed, &c)
+	if c.Type != typ {
+		return fmt.Errorf("expected %s metadata, got %q", typ, c.Type)
+	}
+	return nil
+}
+
+// checkHashes checks b against the expected length, if it is known, and all
+// of the hashes we know how to compute.  At least one hash must be known
+// for a check to pass, unless there are no hashes at all.
+func checkHashes(b []byte, length int64, hashes map[string]string) error {
+	if length != 0 && int64(len(b)) != length {
+		return fmt.Errorf("length %d, expected %d", len(b), length)
+	}
+
+	known := 0
+	for alg, want := range hashes {
+		var h hash.Hash
+		switch alg {
+		case "sha256":
+			h = sha256.New()
+		case "sha512":
+			h = sha512.New()
+		default:
+			continue
+		}
+		h.Write(b)
+		w, err := hex.DecodeString(want)
+		if err != nil || subtle.ConstantTimeCompare(h.Sum(nil), w) != 1 {
+			return fmt.Errorf("%s mismatch", alg)
+		}
+		known++
+	}
+	if known == 0 && len(hashes) > 0 {
+		return errors.New("no supported hash algorithm")
+	}
+	return nil
+}
+
+type tufClient struct {
+	dir        string // trusted metadata directory
+	metaURL    string
+	targetsURL string
+	now        time.Time
+
+	root      tufRoot
+	timestamp *tufMeta
+	snapshot  *tufMeta
+	targets   map[string]*tufTargets // by file in dir
+}
+
+func (c *tufClient) load(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(c.dir, name))
+}
+
+func (c *tufClient) save(name string, b []byte) error {
+	return writeFileAtomic(filepath.Join(c.dir, name), b, 0644)
+}
+
+func (c *tufClient) fetch(name string, max int64) ([]byte, error) {
+	if !*qflag {
+		fmt.Println("GET", c.metaURL+"/"+name)
+	}
+	return fetchBytes(c.metaURL+"/"+name, max)
+}
+
+func (c *tufClient) expired(m *tufCommon) error {
+	if !c.now.Before(m.Expires) {
+		return fmt.Errorf("%s metadata expired at %s", m.Type, m.Expires)
+	}
+	return nil
+}
+
+// open loads the trusted root, and whatever timestamp and snapshot
+// metadata is left from previous runs and still checks out.
+func (c *tufClient) open() error {
+	b, err := c.load("root.json")
+	if err != nil {
+		return err
+	}
+	// The trusted root has to be signed by itself.
+	var r tufRoot
+	if err = json.Unmarshal(b, &struct {
+		Signed *tufRoot `json:"signed"`
+	}{&r}); err != nil {
+		return err
+	}
+	if err = tufParse(b, "root", r.Keys, r.Roles["root"], &c.root); err != nil {
+		return fmt.Errorf("trusted root: %w", err)
+	}
+
+	if b, err := c.load("timestamp.json"); err == nil {
+		var m tufMeta
+		if tufParse(b, "timestamp", c.root.Keys,
+			c.root.Roles["timestamp"], &m) == nil {
+			c.timestamp = &m
+		}
+	}
+	if b, err := c.load("snapshot.json"); err == nil {
+		var m tufMeta
+		if tufParse(b, "snapshot", c.root.Keys,
+			c.root.Roles["snapshot"], &m) == nil {
+			c.snapshot = &m
+		}
+	}
+	return nil
+}
+
+func sameKeys(a, b tufRole) bool {
+	if a.Threshold != b.Threshold || len(a.KeyIDs) != len(b.KeyIDs) {
+		return false
+	}
+	ids := make(map[string]bool)
+	for _, id := range a.KeyIDs {
+		ids[id] = true
+	}
+	for _, id := range b.KeyIDs {
+		if !ids[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *tufClient) updateRoot() error {
+	old := c.root
+	for i := 0; i < tufMaxRotations; i++ {
+		next := c.root.Version + 1
+		b, err := c.fetch(fmt.Sprintf("%d.root.json", next), tufMaxRoot)
+		var serr *statusError
+		if errors.As(err, &serr) &&
+			(serr.code == 404 || serr.code == 403) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// A new root must be signed both by the old root's keys and
+		// its own.
+		var r tufRoot
+		err = tufParse(b, "root", c.root.Keys, c.root.Roles["root"], &r)
+		if err != nil {
+			return err
+		}
+		err = tufParse(b, "root", r.Keys, r.Roles["root"], &r)
+		if err != nil {
+			return err
+		}
+		if r.Version != next {
+			return fmt.Errorf("root version %d, expected %d",
+				r.Version, next)
+		}
+		c.root = r
+		if err = c.save("root.json", b); err != nil {
+			return err
+		}
+	}
+
+	if err := c.expired(&c.root.tufCommon); err != nil {
+		return err
+	}
+
+	// Rotated keys invalidate whatever we had signed with the old ones,
+	// or we'd never be able to recover from a fast-forward attack.
+	if !sameKeys(old.Roles["timestamp"], c.root.Roles["timestamp"]) ||
+		!sameKeys(old.Roles["snapshot"], c.root.Roles["snapshot"]) {
+		os.Remove(filepath.Join(c.dir, "timestamp.json"))
+		os.Remove(filepath.Join(c.dir, "snapshot.json"))
+		c.timestamp = nil
+		c.snapshot = nil
+	}
+	return nil
+}
+
+func (c *tufClient) updateTimestamp() error {
+	b, err := c.fetch("timestamp.json", tufMaxTimestamp)
+	if err != nil {
+		return err
+	}
+	var m tufMeta
+	err = tufParse(b, "timestamp", c.root.Keys, c.root.Roles["timestamp"], &m)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.Meta["snapshot.json"]; !ok {
+		return errors.New("timestamp: no snapshot.json")
+	}
+
+	if old := c.timestamp; old != nil {
+		if m.Version < old.Version {
+			return fmt.Errorf("timestamp rolled back from %d to %d",
+				old.Version, m.Version)
+		}
+		ov := old.Meta["snapshot.json"].Version
+		if nv := m.Meta["snapshot.json"].Version; nv < ov {
+			return fmt.Errorf("snapshot rolled back from %d to %d",
+				ov, nv)
+		}
+	}
+	if err = c.expired(&m.tufCommon); err != nil {
+		return err
+	}
+	c.timestamp = &m
+	return c.save("timestamp.json", b)
+}
+
+func (c *tufClient) updateSnapshot() error {
+	fi := c.timestamp.Meta["snapshot.json"]
+	if s := c.snapshot; s != nil && s.Version == fi.Version &&
+		c.expired(&s.tufCommon) == nil {
+		return nil
+	}
+
+	name := "snapshot.json"
+	if c.root.ConsistentSnapshot {
+		name = fmt.Sprintf("%d.%s", fi.Version, name)
+	}
+	max := fi.Length
+	if max == 0 {
+		max = tufMaxSnapshot
+	}
+	b, err := c.fetch(name, max)
+	if err != nil {
+		return err
+	}
+	if err = checkHashes(b, fi.Length, fi.Hashes); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+
+	var m tufMeta
+	err = tufParse(b, "snapshot", c.root.Keys, c.root.Roles["snapshot"], &m)
+	if err != nil {
+		return err
+	}
+	if m.Version != fi.Version {
+		return fmt.Errorf("snapshot version %d, expected %d",
+			m.Version, fi.Version)
+	}
+	if old := c.snapshot; old != nil {
+		for name, ofi := range old.Meta {
+			nfi, ok := m.Meta[name]
+			if !ok {
+				return fmt.Errorf("snapshot: %s removed", name)
+			}
+			if nfi.Version < ofi.Version {
+				return fmt.Errorf("%s rolled back from %d to %d",
+					name, ofi.Version, nfi.Version)
+			}
+		}
+	}
+	if err = c.expired(&m.tufCommon); err != nil {
+		return err
+	}
+	c.snapshot = &m
+	return c.save("snapshot.json", b)
+}
+
+// loadTargets gets the targets metadata of the named role, as signed by
+// keys.  A copy left from a previous run is reused if it is still current.
+// Delegated roles are kept apart from the top-level ones, so that one
+// named root can't take the trusted root's place.
+func (c *tufClient) loadTargets(name string, delegated bool, keys map[string]tufKey, role tufRole) (*tufTargets, error) {
+	file := url.PathEscape(name) + ".json"
+	local := file
+	if delegated {
+		local = path.Join("delegated", file)
+	}
+	if t, ok := c.targets[local]; ok {
+		return t, nil
+	}
+	fi, ok := c.snapshot.Meta[name+".json"]
+	if !ok {
+		return nil, fmt.Errorf("snapshot: no %s.json", name)
+	}
+
+	var t tufTargets
+	if b, err := c.load(local); err == nil &&
+		tufParse(b, "targets", keys, role, &t) == nil &&
+		t.Version == fi.Version && c.expired(&t.tufCommon) == nil {
+		c.targets[local] = &t
+		return &t, nil
+	}
+
+	remote := file
+	if c.root.ConsistentSnapshot {
+		remote = fmt.Sprintf("%d.%s", fi.Version, file)
+	}
+	max := fi.Length
+	if max == 0 {
+		max = tufMaxTargets
+	}
+	b, err := c.fetch(remote, max)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkHashes(b, fi.Length, fi.Hashes); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	t = tufTargets{}
+	if err = tufParse(b, "targets", keys, role, &t); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if t.Version != fi.Version {
+		return nil, fmt.Errorf("%s version %d, expected %d",
+			name, t.Version, fi.Version)
+	}
+	if err = c.expired(&t.tufCommon); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	c.targets[local] = &t
+	if delegated {
+		err = os.MkdirAll(filepath.Join(c.dir, "delegated"), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &t, c.save(local, b)
+}
+
+func (d *tufDelegation) matches(target string) bool {
+	for _, p := range d.Paths {
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	if len(d.PathHashPrefixes) > 0 {
+		h := sha256.Sum256([]byte(target))
+		hs := hex.EncodeToString(h[:])
+		for _, p := range d.PathHashPrefixes {
+			if strings.HasPrefix(hs, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findTarget looks target up by a preorder depth-first search of the
+// delegation tree, starting at the top-level targets role.
+func (c *tufClient) findTarget(target string) (*tufFileInfo, error) {
+	type visit struct {
+		name      string
+		delegated bool
+		keys      map[string]tufKey
+		role      tufRole
+	}
+	stack := []visit{{"targets", false, c.root.Keys, c.root.Roles["targets"]}}
+	seen := make(map[string]bool)
+
+	for len(stack) > 0 && len(seen) < tufMaxDelegation {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[v.name] {
+			continue
+		}
+		seen[v.name] = true
+
+		t, err := c.loadTargets(v.name, v.delegated, v.keys, v.role)
+		if err != nil {
+			return nil, err
+		}
+		if fi, ok := t.Targets[target]; ok {
+			return &fi, nil
+		}
+		if t.Delegations == nil {
+			continue
+		}
+
+		var children []visit
+		for i := range t.Delegations.Roles {
+			d := &t.Delegations.Roles[i]
+			if !d.matches(target) {
+				continue
+			}
+			children = append(children, visit{d.Name, true,
+				t.Delegations.Keys, tufRole{d.KeyIDs, d.Threshold}})
+			if d.Terminating {
+				stack = stack[:0]
+				break
+			}
+		}
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, children[i])
+		}
+	}
+	return nil, fmt.Errorf("%s: no such target", target)
+}
+
+func (c *tufClient) refresh() error {
+	if err := c.updateRoot(); err != nil {
+		return err
+	}
+	if err := c.updateTimestamp(); err != nil {
+		return err
+	}
+	return c.updateSnapshot()
+}
+
+// download gets target, verified against its trusted file info, into dir.
+func (c *tufClient) download(target, dir string) error {
+	for _, e := range strings.Split(target, "/") {
+		if e == "" || e == "." || e == ".." {
+			return fmt.Errorf("%s: bad target path", target)
+		}
+	}
+	fi, err := c.findTarget(target)
+	if err != nil {
+		return err
+	}
+
+	remote := target
+	if c.root.ConsistentSnapshot {
+		h, ok := fi.Hashes["sha256"]
+		if !ok {
+			for _, h = range fi.Hashes {
+				break
+			}
+		}
+		d, f := path.Split(target)
+		remote = d + h + "." + f
+	}
+	u := c.targetsURL + "/" + remote
+	if !*qflag {
+		fmt.Println("GET", u)
+	}
+	b, err := fetchBytes(u, fi.Length)
+	if err != nil {
+		return err
+	}
+	if len(fi.Hashes) == 0 {
+		return fmt.Errorf("%s: no hashes", target)
+	}
+	if err = checkHashes(b, fi.Length, fi.Hashes); err != nil {
+		return fmt.Errorf("%s: %w", target, err)
+	}
+
+	name := filepath.Join(dir, filepath.FromSlash(target))
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(name, b, 0644)
+}
+
+func tufMain(args []string) error {
+	fs := flag.NewFlagSet("tuf", flag.ExitOnError)
+	mflag := fs.String("m", ".tuf", "trusted metadata directory")
+	rflag := fs.String("root", "",
+		"initial trusted root.json, if there's none in the metadata directory")
+	uflag := fs.String("u", "", "repository metadata URL")
+	tflag := fs.String("t", "", "repository targets URL (default: metadata URL)")
+	oflag := fs.String("o", ".", "output directory")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),
+			"usage: goget tuf -u url [options] target ...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *uflag == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c := &tufClient{
+		dir:        *mflag,
+		metaURL:    strings.TrimSuffix(*uflag, "/"),
+		targetsURL: strings.TrimSuffix(*tflag, "/"),
+		now:        time.Now(),
+		targets:    make(map[string]*tufTargets),
+	}
+	if c.targetsURL == "" {
+		c.targetsURL = c.metaURL
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	lk, err := lockFile(filepath.Join(c.dir, ".lock"), 0644, true)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lk, false)
+
+	if _, err := c.load("root.json"); errors.Is(err, os.ErrNotExist) {
+		if *rflag == "" {
+			return fmt.Errorf("no root.json in %s, and no -root given",
+				c.dir)
+		}
+		b, err := os.ReadFile(*rflag)
+		if err != nil {
+			return err
+		}
+		if err = c.save("root.json", b); err != nil {
+			return err
+		}
+	}
+	if err := c.open(); err != nil {
+		return err
+	}
+	if err := c.refresh(); err != nil {
+		return err
+	}
+
+	failed := false
+	for _, target := range fs.Args() {
+		if err := c.download(target, *oflag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("some targets failed")
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2024 Alexander Arkhipov <aa@manpager.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type tufTestKey struct {
+	id   string
+	priv ed25519.PrivateKey
+}
+
+func newTUFTestKey(t *testing.T, id string) tufTestKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tufTestKey{id, priv}
+}
+
+func (k tufTestKey) tufKey() map[string]any {
+	pub := k.priv.Public().(ed25519.PublicKey)
+	return map[string]any{
+		"keytype": "ed25519",
+		"scheme":  "ed25519",
+		"keyval":  map[string]string{"public": hex.EncodeToString(pub)},
+	}
+}
+
+// tufSign wraps signed in an envelope with a signature by each of keys.
+func tufSign(t *testing.T, signed map[string]any, keys ...tufTestKey) []byte {
+	raw, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := canonicalJSON(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sigs []map[string]string
+	for _, k := range keys {
+		sigs = append(sigs, map[string]string{
+			"keyid": k.id,
+			"sig":   hex.EncodeToString(ed25519.Sign(k.priv, msg)),
+		})
+	}
+	b, err := json.Marshal(map[string]any{
+		"signatures": sigs,
+		"signed":     json.RawMessage(raw),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func tufFileMeta(b []byte) map[string]any {
+	h := sha256.Sum256(b)
+	return map[string]any{
+		"version": 1,
+		"length":  len(b),
+		"hashes":  map[string]string{"sha256": hex.EncodeToString(h[:])},
+	}
+}
+
+// tufTestRepo serves a repository with one target in the top-level
+// targets role, and one in a delegated role perversely named root.
+func tufTestRepo(t *testing.T) (*httptest.Server, []byte) {
+	root := newTUFTestKey(t, "root")
+	ts := newTUFTestKey(t, "timestamp")
+	snap := newTUFTestKey(t, "snapshot")
+	targ := newTUFTestKey(t, "targets")
+	deleg := newTUFTestKey(t, "delegated")
+	expires := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	role := func(k tufTestKey) map[string]any {
+		return map[string]any{"keyids": []string{k.id}, "threshold": 1}
+	}
+
+	files := map[string][]byte{
+		"targets/hello.txt": []byte("hello\n"),
+		"targets/evil/x":    []byte("delegated\n"),
+	}
+	rootMeta := tufSign(t, map[string]any{
+		"_type":               "root",
+		"version":             1,
+		"expires":             expires,
+		"consistent_snapshot": false,
+		"keys": map[string]any{
+			root.id: root.tufKey(),
+			ts.id:   ts.tufKey(),
+			snap.id: snap.tufKey(),
+			targ.id: targ.tufKey(),
+		},
+		"roles": map[string]any{
+			"root":      role(root),
+			"timestamp": role(ts),
+			"snapshot":  role(snap),
+			"targets":   role(targ),
+		},
+	}, root)
+
+	delegMeta := tufSign(t, map[string]any{
+		"_type":   "targets",
+		"version": 1,
+		"expires": expires,
+		"targets": map[string]any{
+			"evil/x": tufFileMeta(files["targets/evil/x"]),
+		},
+	}, deleg)
+	targetsMeta := tufSign(t, map[string]any{
+		"_type":   "targets",
+		"version": 1,
+		"expires": expires,
+		"targets": map[string]any{
+			"hello.txt": tufFileMeta(files["targets/hello.txt"]),
+		},
+		"delegations": map[string]any{
+			"keys": map[string]any{deleg.id: deleg.tufKey()},
+			"roles": []map[string]any{{
+				"name":      "root",
+				"keyids":    []string{deleg.id},
+				"threshold": 1,
+				"paths":     []string{"evil/*"},
+			}},
+		},
+	}, targ)
+	snapMeta := tufSign(t, map[string]any{
+		"_type":   "snapshot",
+		"version": 1,
+		"expires": expires,
+		"meta": map[string]any{
+			"targets.json": map[string]any{"version": 1},
+			"root.json":    map[string]any{"version": 1},
+		},
+	}, snap)
+	tsMeta := tufSign(t, map[string]any{
+		"_type":   "timestamp",
+		"version": 1,
+		"expires": expires,
+		"meta":    map[string]any{"snapshot.json": tufFileMeta(snapMeta)},
+	}, ts)
+
+	files["timestamp.json"] = tsMeta
+	files["snapshot.json"] = snapMeta
+	files["targets.json"] = targetsMeta
+	files["root.json"] = delegMeta // the delegated role, not the root
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := files[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, rootMeta
+}
+
+func newTestTUFClient(t *testing.T, srv *httptest.Server, rootMeta []byte) *tufClient {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "root.json"), rootMeta, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &tufClient{
+		dir:        dir,
+		metaURL:    srv.URL,
+		targetsURL: srv.URL + "/targets",
+		now:        time.Now(),
+		targets:    make(map[string]*tufTargets),
+	}
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTUFDownload(t *testing.T) {
+	*qflag = true
+	srv, rootMeta := tufTestRepo(t)
+	c := newTestTUFClient(t, srv, rootMeta)
+
+	out := t.TempDir()
+	if err := c.download("hello.txt", out); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(out, "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello\n" {
+		t.Errorf("hello.txt: got %q", b)
+	}
+	if err := c.download("missing.txt", out); err == nil {
+		t.Error("missing.txt: no error")
+	}
+}
+
+func TestTUFDelegatedRoot(t *testing.T) {
+	*qflag = true
+	srv, rootMeta := tufTestRepo(t)
+	c := newTestTUFClient(t, srv, rootMeta)
+
+	if err := c.download("evil/x", t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.load("root.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, rootMeta) {
+		t.Fatal("delegated role named root replaced the trusted root")
+	}
+	if _, err := c.load("delegated/root.json"); err != nil {
+		t.Error(err)
+	}
+
+	// The next run has to still trust its root.
+	c2 := &tufClient{dir: c.dir, targets: make(map[string]*tufTargets)}
+	if err := c2.open(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTUFThresholdDistinctKeys(t *testing.T) {
+	k := newTUFTestKey(t, "a")
+	keys := map[string]tufKey{}
+	for _, id := range []string{"a", "b"} {
+		b, _ := json.Marshal(k.tufKey())
+		var tk tufKey
+		json.Unmarshal(b, &tk)
+		keys[id] = tk
+	}
+	b := tufSign(t, map[string]any{"_type": "targets"}, k, tufTestKey{"b", k.priv})
+	var env tufEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		t.Fatal(err)
+	}
+
+	role := tufRole{KeyIDs: []string{"a", "b"}, Threshold: 2}
+	if err := tufVerify(&env, keys, role); err == nil {
+		t.Error("one key under two key IDs met a threshold of 2")
+	}
+	role.Threshold = 1
+	if err := tufVerify(&env, keys, role); err != nil {
+		t.Error(err)
+	}
+}